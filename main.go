@@ -4,18 +4,26 @@ import (
 	"archive/zip"
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -52,11 +60,27 @@ type AppInfo struct {
 
 // 请求结构体
 type RunRequest struct {
-	Platform    string `json:"platform"`
-	URL         string `json:"url"`
-	TaskID      string `json:"taskID"`      // 添加任务ID字段
-	Config      Config `json:"config"`      // 添加配置字段
-	VideoFormat string `json:"videoFormat"` // 添加视频格式字段
+	Platform    string       `json:"platform"`
+	URL         string       `json:"url"`
+	TaskID      string       `json:"taskID"`          // 添加任务ID字段
+	Config      Config       `json:"config"`          // 添加配置字段
+	VideoFormat string       `json:"videoFormat"`     // 添加视频格式字段
+	Retry       *RetryPolicy `json:"retry,omitempty"` // 重试策略，为空时使用服务端设置
+	// 只下载播放列表中的指定条目，例如 "1,3,5-7"（对应/api/probe返回的条目序号）
+	PlaylistItems string `json:"playlistItems,omitempty"`
+	// 视频库中已有相同视频时的处理方式：skip、overwrite或keep，为空时使用服务端设置
+	Duplicate string `json:"duplicate,omitempty"`
+	// 明确指定的格式和编码偏好，为空时使用平台或高级配置的默认格式
+	Format *FormatSelection `json:"format,omitempty"`
+}
+
+// 格式选择结构体
+type FormatSelection struct {
+	FormatID   string `json:"formatID"`   // /api/probe返回的格式ID或组合，例如 "137+140"
+	VideoCodec string `json:"videoCodec"` // 视频编码偏好: av1、vp9、h264
+	AudioCodec string `json:"audioCodec"` // 音频编码偏好: opus、aac
+	MaxFPS     int    `json:"maxFPS"`     // 最高帧率，0表示不限制
+	HDR        string `json:"hdr"`        // HDR: prefer、avoid、only、exclude，空表示不限制
 }
 
 // 停止请求结构体
@@ -64,24 +88,164 @@ type StopRequest struct {
 	TaskID string `json:"taskID"` // 要停止的任务ID
 }
 
+// 暂停/恢复请求结构体
+type PauseRequest struct {
+	TaskID string `json:"taskID"` // 要暂停或恢复的任务ID
+}
+
+// 元数据预览请求结构体
+type ProbeRequest struct {
+	URL    string `json:"url"`
+	Config Config `json:"config"` // 用于选择Cookie来源
+}
+
+// 元数据预览结果（由yt-dlp -J的输出整理而来）
+type ProbeResult struct {
+	ID         string        `json:"id"`
+	Title      string        `json:"title"`
+	Uploader   string        `json:"uploader"`
+	Duration   float64       `json:"duration"`
+	Thumbnail  string        `json:"thumbnail"`
+	WebpageURL string        `json:"webpageURL"`
+	Extractor  string        `json:"extractor"`
+	IsPlaylist bool          `json:"isPlaylist"`
+	Entries    []ProbeEntry  `json:"entries"`
+	Formats    []ProbeFormat `json:"formats"`
+}
+
+// 播放列表条目
+type ProbeEntry struct {
+	Index    int     `json:"index"` // 从1开始，对应--playlist-items
+	ID       string  `json:"id"`
+	Title    string  `json:"title"`
+	URL      string  `json:"url"`
+	Duration float64 `json:"duration"`
+	Uploader string  `json:"uploader"`
+}
+
+// 可下载的格式
+type ProbeFormat struct {
+	FormatID       string  `json:"formatID"`
+	Ext            string  `json:"ext"`
+	Resolution     string  `json:"resolution"`
+	Width          int     `json:"width"`
+	Height         int     `json:"height"`
+	FPS            float64 `json:"fps"`
+	VCodec         string  `json:"vcodec"`
+	ACodec         string  `json:"acodec"`
+	DynamicRange   string  `json:"dynamicRange"`
+	TBR            float64 `json:"tbr"`
+	Filesize       int64   `json:"filesize"`
+	FilesizeApprox int64   `json:"filesizeApprox"`
+	FormatNote     string  `json:"formatNote"`
+}
+
+// yt-dlp -J输出中用到的字段
+type ytdlpInfo struct {
+	ID          string       `json:"id"`
+	Type        string       `json:"_type"`
+	Title       string       `json:"title"`
+	Uploader    string       `json:"uploader"`
+	Duration    float64      `json:"duration"`
+	Thumbnail   string       `json:"thumbnail"`
+	URL         string       `json:"url"`
+	WebpageURL  string       `json:"webpage_url"`
+	Extractor   string       `json:"extractor_key"`
+	UploadDate  string       `json:"upload_date"`
+	Description string       `json:"description"`
+	Tags        []string     `json:"tags"`
+	Entries     []*ytdlpInfo `json:"entries"`
+	Formats     []struct {
+		FormatID       string  `json:"format_id"`
+		Ext            string  `json:"ext"`
+		Resolution     string  `json:"resolution"`
+		Width          int     `json:"width"`
+		Height         int     `json:"height"`
+		FPS            float64 `json:"fps"`
+		VCodec         string  `json:"vcodec"`
+		ACodec         string  `json:"acodec"`
+		DynamicRange   string  `json:"dynamic_range"`
+		TBR            float64 `json:"tbr"`
+		Filesize       float64 `json:"filesize"`
+		FilesizeApprox float64 `json:"filesize_approx"`
+		FormatNote     string  `json:"format_note"`
+	} `json:"formats"`
+}
+
 // 视频文件信息结构体
 type VideoInfo struct {
-	Name      string    `json:"name"`
-	Size      int64     `json:"size"`
-	CreatedAt time.Time `json:"created_at"`
+	Name      string         `json:"name"`
+	Size      int64          `json:"size"`
+	CreatedAt time.Time      `json:"created_at"`
+	Media     *MediaInfo     `json:"media,omitempty"`    // 媒体信息，尚未分析完成时为空
+	Kind      string         `json:"kind"`               // 媒体类型：video、audio、subtitle
+	Related   []RelatedAsset `json:"related,omitempty"`  // 同名字幕、单独下载的音频等关联文件
+	Title     string         `json:"title,omitempty"`    // 来源信息中的标题
+	Uploader  string         `json:"uploader,omitempty"` // 来源信息中的上传者
 }
 
 // 客户端连接信息
 type ClientInfo struct {
 	Conn   *websocket.Conn
-	TaskID string // 当前任务ID
+	TaskID string          // 当前任务ID
+	Topics map[string]bool // 订阅的主题，例如 "tasks.<id>"、"tasks.*"、"library"、"tools"
+}
+
+// WebSocket订阅主题
+const (
+	TopicAllTasks = "tasks.*" // 所有下载任务的消息
+	TopicLibrary  = "library" // 视频库变化
+	TopicTools    = "tools"   // yt-dlp更新和FFmpeg下载进度
+)
+
+// 视频库变化事件（通过"library"主题发送）
+type LibraryEvent struct {
+	Action  string `json:"action"` // "added", "removed", "renamed", "modified"，缩略图生成完成时为 "thumbnail"
+	Name    string `json:"name"`
+	OldName string `json:"oldName,omitempty"`
+}
+
+// 客户端发送的WebSocket消息
+type WSClientMessage struct {
+	Type   string   `json:"type"`   // "register", "subscribe", "unsubscribe"
+	TaskID string   `json:"taskID"` // register时的任务ID
+	Seq    int64    `json:"seq"`    // 客户端已收到的最后序号，用于回放
+	Topics []string `json:"topics"` // subscribe/unsubscribe的主题列表
+}
+
+// 判断客户端是否订阅了指定任务（调用方需持有clientsMu）
+func (c *ClientInfo) wantsTask(taskID string) bool {
+	return c.TaskID == taskID || c.Topics[TopicAllTasks] || c.Topics[taskTopic(taskID)]
+}
+
+// 任务对应的订阅主题
+func taskTopic(taskID string) string {
+	return "tasks." + taskID
 }
 
 // WebSocket消息结构体
 type WSMessage struct {
-	TaskID  string `json:"taskID"`
-	Message string `json:"message"`
-	Type    string `json:"type"` // "log", "progress", "complete", "error"
+	TaskID   string        `json:"taskID"`
+	Message  string        `json:"message"`
+	Type     string        `json:"type"`               // "log", "progress", "complete", "error"
+	Progress *ProgressInfo `json:"progress,omitempty"` // "progress"类型消息的结构化进度
+	Seq      int64         `json:"seq,omitempty"`      // 任务内的消息序号
+	Topic    string        `json:"topic,omitempty"`    // 全局主题消息的主题名称
+	Data     interface{}   `json:"data,omitempty"`     // 全局主题消息的数据
+}
+
+// 下载进度信息（从yt-dlp输出中解析）
+type ProgressInfo struct {
+	Percent         float64 `json:"percent"`
+	DownloadedBytes int64   `json:"downloadedBytes"`
+	TotalBytes      int64   `json:"totalBytes"`
+	TotalEstimated  bool    `json:"totalEstimated"` // 总大小是否为估算值
+	Speed           int64   `json:"speed"`          // 字节/秒
+	ETA             int     `json:"eta"`            // 剩余秒数，未知时为-1
+	FragmentIndex   int     `json:"fragmentIndex,omitempty"`
+	FragmentCount   int     `json:"fragmentCount,omitempty"`
+	PlaylistIndex   int     `json:"playlistIndex,omitempty"`
+	PlaylistCount   int     `json:"playlistCount,omitempty"`
 }
 
 // 配置结构体
@@ -105,6 +269,93 @@ type Config struct {
 	RateLimit            string `json:"rateLimit"`
 	ContinueOnError      bool   `json:"continueOnError"`
 	EnableReferer        bool   `json:"enableReferer"`
+	CookieMode           string `json:"cookieMode"`    // Cookie来源: none、browser、file，为空时从Firefox读取
+	CookieBrowser        string `json:"cookieBrowser"` // 读取Cookie的浏览器，例如 firefox、chrome、edge
+	CookieProfile        string `json:"cookieProfile"` // 浏览器配置文件名称或路径，为空时使用默认配置文件
+	CookieSite           string `json:"cookieSite"`    // 使用的Cookie文件站点名，为空时按网址自动匹配
+}
+
+// 服务端设置结构体（与前端的高级配置分开保存在settings.json中）
+type Settings struct {
+	MaxConcurrentDownloads int            `json:"maxConcurrentDownloads"` // 同时运行的yt-dlp进程数量
+	Retry                  RetryPolicy    `json:"retry"`                  // 默认重试策略
+	LibraryRoot            string         `json:"libraryRoot"`            // 视频库根目录，下载的文件保存在这里
+	LibraryMaxDepth        int            `json:"libraryMaxDepth"`        // 扫描视频库子目录的最大深度，0表示只扫描根目录
+	LibraryIgnore          []string       `json:"libraryIgnore"`          // 扫描时忽略的文件或目录（通配符，匹配名称或相对路径）
+	TempDir                string         `json:"tempDir"`                // 下载过程中临时文件的目录，为空时与视频库相同
+	LibraryWatchInterval   int            `json:"libraryWatchInterval"`   // 扫描视频库变化的间隔秒数，0表示不监视
+	OutputTemplate         string         `json:"outputTemplate"`         // yt-dlp -o 输出模板（相对视频库根目录），为空时使用yt-dlp的默认值
+	DuplicatePolicy        string         `json:"duplicatePolicy"`        // 视频库中已有相同视频时的默认处理方式：skip、overwrite或keep
+	MaxLibrarySizeGB       float64        `json:"maxLibrarySizeGB"`       // 视频库容量上限（GB），0表示不限制
+	MinFreeDiskGB          float64        `json:"minFreeDiskGB"`          // 磁盘最少保留的剩余空间（GB），0表示不检查
+	PurgeForFreeSpace      bool           `json:"purgeForFreeSpace"`      // 磁盘剩余空间不足时是否清理视频库中的文件，默认只拒绝新的下载
+	FolderMaxAgeDays       map[string]int `json:"folderMaxAgeDays"`       // 各目录中文件的保留天数（键为相对路径，""表示整个视频库）
+	RetentionAction        string         `json:"retentionAction"`        // 超出限制的文件的处理方式：trash、delete或archive
+	RetentionOrder         string         `json:"retentionOrder"`         // 清理顺序：oldest（最旧的文件）或unwatched（没有看过的优先）
+	ArchiveDir             string         `json:"archiveDir"`             // retentionAction为archive时文件移动到的目录
+	JanitorInterval        int            `json:"janitorInterval"`        // 存储清理的间隔分钟数，0表示不自动清理
+	TrashRetentionDays     int            `json:"trashRetentionDays"`     // 回收站中的文件保留天数，超过后永久删除，0表示不自动清理
+}
+
+// 下载失败后的重试策略
+type RetryPolicy struct {
+	MaxAttempts int `json:"maxAttempts"` // 最大尝试次数（包含首次下载），1表示不重试
+	BaseDelay   int `json:"baseDelay"`   // 首次重试前等待的秒数，之后每次翻倍
+	MaxDelay    int `json:"maxDelay"`    // 重试等待的最长秒数
+}
+
+// 单次运行yt-dlp的记录
+type JobAttempt struct {
+	Number     int       `json:"number"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Status     string    `json:"status"` // 本次运行结束后的任务状态
+	ExitCode   *int      `json:"exitCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Transient  string    `json:"transient,omitempty"` // 识别出的临时错误（可重试）
+}
+
+// 下载任务状态
+const (
+	JobQueued   = "queued"   // 排队等待中
+	JobRunning  = "running"  // 正在下载
+	JobPaused   = "paused"   // 已暂停（保留临时文件）
+	JobRetrying = "retrying" // 下载失败，等待自动重试
+	JobFinished = "finished" // 下载完成
+	JobFailed   = "failed"   // 下载失败
+	JobStopped  = "stopped"  // 用户手动停止
+)
+
+// 下载任务记录（持久化保存在queue.json中）
+type Job struct {
+	ID          string           `json:"id"`
+	Platform    string           `json:"platform"`
+	URL         string           `json:"url"`
+	Config      Config           `json:"config"`
+	VideoFormat string           `json:"videoFormat"`
+	Format      *FormatSelection `json:"format,omitempty"`    // 请求中的格式选择
+	Dir         string           `json:"dir,omitempty"`       // 下载目录（加入队列时的视频库根目录）
+	Args        []string         `json:"args"`                // yt-dlp命令参数
+	Duplicate   string           `json:"duplicate,omitempty"` // 重复视频的处理方式
+	Skipped     []string         `json:"skipped,omitempty"`   // 因视频库中已有而跳过的视频（已有文件的相对路径或视频标题）
+	KeepCover   bool             `json:"keepCover,omitempty"` // 参数中本来就有--write-thumbnail，导入缩略图后保留封面文件
+	Status      string           `json:"status"`              // 任务状态
+	Filename    string           `json:"filename"`            // 检测到的下载文件名
+	Error       string           `json:"error,omitempty"`
+	ExitCode    *int             `json:"exitCode,omitempty"` // yt-dlp退出码
+	Logs        []string         `json:"logs"`               // 最近的日志输出
+	Progress    *ProgressInfo    `json:"progress,omitempty"` // 最近的下载进度
+	Retry       RetryPolicy      `json:"retry"`              // 重试策略
+	Attempts    []JobAttempt     `json:"attempts"`           // 每次运行的记录
+	NextRetryAt *time.Time       `json:"nextRetryAt,omitempty"`
+	CreatedAt   time.Time        `json:"createdAt"`
+	StartedAt   *time.Time       `json:"startedAt,omitempty"`
+	FinishedAt  *time.Time       `json:"finishedAt,omitempty"`
+
+	cmd       *exec.Cmd // 正在运行的yt-dlp进程
+	interrupt string    // 进程退出后任务应进入的状态（JobStopped、JobPaused或JobQueued）
+	transient string    // 本次运行中识别出的临时错误
+	files     []string  // 运行中检测到的所有下载文件（用于整理来源信息）
 }
 
 // 版本信息结构体
@@ -184,6 +435,105 @@ func extractFilename(output string) string {
 	return ""
 }
 
+// yt-dlp进度输出的匹配规则
+var (
+	progressPercentRe  = regexp.MustCompile(`^\[download\]\s+([\d.]+)%\s+of\s+(~)?\s*([\d.]+\s*[KMGTPE]?i?B)`)
+	progressSpeedRe    = regexp.MustCompile(`\sat\s+([\d.]+\s*[KMGTPE]?i?B)/s`)
+	progressETARe      = regexp.MustCompile(`\sETA\s+(\d+(?::\d+)*)`)
+	progressFragRe     = regexp.MustCompile(`\(frag\s+(\d+)/(\d+)\)`)
+	progressPlaylistRe = regexp.MustCompile(`^\[download\]\s+Downloading\s+(?:item|video)\s+(\d+)\s+of\s+(\d+)`)
+	transientErrorRe   = regexp.MustCompile(`(?i)HTTP Error (?:429|5\d\d)|timed out|Connection (?:reset|refused|aborted)|fragment \d+ not found|Giving up after \d+ fragment retries|Unable to download fragment|Temporary failure in name resolution|IncompleteRead`)
+	sizeRe             = regexp.MustCompile(`^([\d.]+)\s*([KMGTPE]?)(i?)B$`)
+)
+
+// 从yt-dlp输出中解析下载进度，例如:
+// "[download]  45.3% of 120.00MiB at 3.00MiB/s ETA 00:30 (frag 12/120)"
+func parseProgress(output string) (ProgressInfo, bool) {
+	var progress ProgressInfo
+
+	matches := progressPercentRe.FindStringSubmatch(output)
+	if len(matches) < 4 {
+		return progress, false
+	}
+
+	percent, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return progress, false
+	}
+	progress.Percent = percent
+	progress.TotalEstimated = matches[2] == "~"
+	progress.TotalBytes = parseSize(matches[3])
+	progress.DownloadedBytes = int64(float64(progress.TotalBytes) * percent / 100)
+	progress.ETA = -1
+
+	if m := progressSpeedRe.FindStringSubmatch(output); len(m) > 1 {
+		progress.Speed = parseSize(m[1])
+	}
+	if m := progressETARe.FindStringSubmatch(output); len(m) > 1 {
+		progress.ETA = parseDuration(m[1])
+	}
+	if m := progressFragRe.FindStringSubmatch(output); len(m) > 2 {
+		progress.FragmentIndex, _ = strconv.Atoi(m[1])
+		progress.FragmentCount, _ = strconv.Atoi(m[2])
+	}
+
+	return progress, true
+}
+
+// 从yt-dlp输出中解析播放列表位置，例如 "[download] Downloading item 2 of 10"
+func parsePlaylistItem(output string) (int, int, bool) {
+	matches := progressPlaylistRe.FindStringSubmatch(output)
+	if len(matches) < 3 {
+		return 0, 0, false
+	}
+	index, _ := strconv.Atoi(matches[1])
+	count, _ := strconv.Atoi(matches[2])
+	return index, count, true
+}
+
+// 判断yt-dlp输出是否为可重试的临时错误（HTTP 429/5xx、超时、分片下载失败等），返回匹配到的错误
+func classifyTransientError(output string) string {
+	return transientErrorRe.FindString(output)
+}
+
+// 将 "120.00MiB"、"3.5KiB" 等大小字符串转换为字节数
+func parseSize(value string) int64 {
+	matches := sizeRe.FindStringSubmatch(strings.TrimSpace(value))
+	if len(matches) < 4 {
+		return 0
+	}
+	number, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0
+	}
+
+	base := 1000.0
+	if matches[3] == "i" {
+		base = 1024.0
+	}
+	multiplier := 1.0
+	for _, unit := range "KMGTPE" {
+		multiplier *= base
+		if string(unit) == matches[2] {
+			return int64(number * multiplier)
+		}
+	}
+	return int64(number)
+}
+
+// 将 "00:30"、"01:02:03" 等时间字符串转换为秒数
+func parseDuration(value string) int {
+	seconds := 0
+	for _, part := range strings.Split(value, ":") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return -1
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds
+}
+
 // 全局变量
 var (
 	upgrader = websocket.Upgrader{
@@ -194,18 +544,52 @@ var (
 		},
 	}
 	clients       = make(map[*websocket.Conn]*ClientInfo) // 存储所有WebSocket连接及其信息
-	clientsMu     sync.Mutex                              // 保护clients的互斥锁
-	activeTasks   = make(map[string]*exec.Cmd)            // 存储活跃的下载任务
-	tasksMu       sync.Mutex                              // 保护activeTasks的互斥锁
-	taskFiles     = make(map[string]string)               // 存储任务对应的文件名
-	filesMu       sync.Mutex                              // 保护taskFiles的互斥锁
-	taskFormats   = make(map[string]string)               // 存储任务对应的视频格式
-	formatsMu     sync.Mutex                              // 保护taskFormats的互斥锁
+	clientsMu     sync.Mutex                              // 保护clients和taskBacklogs的互斥锁
+	taskBacklogs  = make(map[string]*messageBacklog)      // 每个任务最近发送过的消息，用于客户端重连后回放
+	jobs          = make([]*Job, 0)                       // 下载队列中的所有任务（按加入顺序）
+	jobsMu        sync.Mutex                              // 保护jobs及任务记录的互斥锁
 	updateTasks   = make(map[string]context.CancelFunc)   // 存储活跃的更新任务
 	updateTasksMu sync.Mutex                              // 保护updateTasks的互斥锁
+	settings      = defaultSettings()                     // 服务端设置
+	settingsMu    sync.Mutex                              // 保护settings的互斥锁
+	retryTimer    *time.Timer                             // 等待下一次自动重试的定时器（由jobsMu保护）
+	holdJobs      bool                                    // 更新yt-dlp期间暂停启动新任务（由jobsMu保护）
+	rules         []*PlatformRule                         // 当前使用的平台规则
+	rulesModTime  time.Time                               // rules.json的修改时间，用于检测文件变化
+	rulesMu       sync.Mutex                              // 保护rules的互斥锁
+)
+
+const (
+	queueFile          = "queue.json"           // 下载队列持久化文件
+	settingsFile       = "settings.json"        // 服务端设置文件
+	maxFinishedJobs    = 200                    // 队列中最多保留的已结束任务数量
+	maxJobLogLines     = 100                    // 每个任务最多保留的日志行数
+	maxTaskBacklog     = 500                    // 每个任务最多缓存的WebSocket消息数量
+	cookiesDir         = "cookies"              // 上传的Cookie文件目录，每个站点一个 <站点>.txt
+	maxCookieFileSize  = 1024 * 1024            // Cookie文件大小上限
+	rulesFile          = "rules.json"           // 平台规则文件（不存在时使用内置规则）
+	mediaIndexFile     = "media_index.json"     // ffprobe媒体信息缓存
+	thumbnailIndexFile = "thumbnail_index.json" // 缩略图等预览缓存对应的源视频状态
+	watchHistoryFile   = "watch_history.json"   // 视频播放记录
 )
 
 func main() {
+	// 加载服务端设置和下载队列，恢复未完成的任务
+	loadSettings()
+	loadQueue()
+	loadMediaIndex()
+	loadThumbnailIndex()
+	loadWatchHistory()
+	go runMediaIndexer()
+	for i := 0; i < thumbnailWorkers; i++ {
+		go runThumbnailWorker()
+	}
+	go runTrashPurger()
+	go runLibraryWatcher()
+	go runStorageJanitor()
+	go scanLibraryMedia()
+	scheduleJobs()
+
 	// 设置静态文件服务
 	fs := http.FileServer(http.Dir("static"))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
@@ -216,15 +600,37 @@ func main() {
 	http.HandleFunc("/ws", handleWebSocket)
 	http.HandleFunc("/run", handleRun)
 	http.HandleFunc("/stop", handleStop)
+	http.HandleFunc("/pause", handlePause)
+	http.HandleFunc("/resume", handleResume)
+	http.HandleFunc("/api/tasks", handleTaskList)
+	http.HandleFunc("/api/tasks/", handleTaskDetail)
+	http.HandleFunc("/api/probe", handleProbe)
+	http.HandleFunc("/api/rules", handleRules)
+	http.HandleFunc("/api/cookies", handleCookieList)
+	http.HandleFunc("/api/cookies/upload", handleCookieUpload)
+	http.HandleFunc("/api/cookies/delete", handleCookieDelete)
 	http.HandleFunc("/api/videos", handleVideoList)
+	http.HandleFunc("/api/videos/", handleVideoDetail)
+	http.HandleFunc("/api/folders", handleFolderTree)
+	http.HandleFunc("/api/duplicates", handleDuplicates)
 	http.HandleFunc("/api/video/", handleVideoStream)
 	http.HandleFunc("/api/video-transcode/", handleVideoTranscode)
+	http.HandleFunc("/api/audio/", handleAudioStream)
+	http.HandleFunc("/api/subtitle/", handleSubtitle)
 	http.HandleFunc("/api/thumbnail/", handleThumbnail)
+	http.HandleFunc("/api/sprite/", handleSprite)
+	http.HandleFunc("/api/preview/", handlePreview)
 	http.HandleFunc("/api/delete", handleDelete)
 	http.HandleFunc("/api/rename", handleRename)
 	http.HandleFunc("/api/batch-delete", handleBatchDelete)
+	http.HandleFunc("/api/trash", handleTrashList)
+	http.HandleFunc("/api/trash/restore", handleTrashAction)
+	http.HandleFunc("/api/trash/purge", handleTrashAction)
+	http.HandleFunc("/api/retention", handleRetention)
 	http.HandleFunc("/api/config/save", handleConfigSave)
 	http.HandleFunc("/api/config/load", handleConfigLoad)
+	http.HandleFunc("/api/settings/save", handleSettingsSave)
+	http.HandleFunc("/api/settings/load", handleSettingsLoad)
 	http.HandleFunc("/api/version/check", handleVersionCheck)
 	http.HandleFunc("/api/version/update", handleVersionUpdate)
 	http.HandleFunc("/api/ffmpeg/check", handleFFmpegCheck)
@@ -269,6 +675,7 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	clients[conn] = &ClientInfo{
 		Conn:   conn,
 		TaskID: "", // 初始时没有任务ID
+		Topics: make(map[string]bool),
 	}
 	clientsMu.Unlock()
 	defer func() {
@@ -279,748 +686,5205 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	// 处理客户端消息
 	for {
-		var msg WSMessage
+		var msg WSClientMessage
 		err := conn.ReadJSON(&msg)
 		if err != nil {
 			log.Printf("读取WebSocket消息错误: %v", err)
 			break
 		}
 
-		// 处理任务ID注册
-		if msg.Type == "register" && msg.TaskID != "" {
-			clientsMu.Lock()
-			if clientInfo, exists := clients[conn]; exists {
+		clientsMu.Lock()
+		clientInfo, exists := clients[conn]
+		if !exists {
+			clientsMu.Unlock()
+			continue
+		}
+
+		switch msg.Type {
+		case "register":
+			// 处理任务ID注册，并回放序号之后的历史消息
+			if msg.TaskID != "" {
 				clientInfo.TaskID = msg.TaskID
 				log.Printf("客户端注册任务ID: %s", msg.TaskID)
+				replayed := replayBacklogLocked(conn, msg.TaskID, msg.Seq)
+				if replayed > 0 {
+					log.Printf("向任务 %s 的客户端回放了 %d 条历史消息", msg.TaskID, replayed)
+				}
 			}
-			clientsMu.Unlock()
+		case "subscribe":
+			// 订阅多个任务或全局主题，单个任务的主题会回放历史消息
+			for _, topic := range msg.Topics {
+				if topic == "" || clientInfo.Topics[topic] {
+					continue
+				}
+				clientInfo.Topics[topic] = true
+				if strings.HasPrefix(topic, "tasks.") && topic != TopicAllTasks {
+					replayBacklogLocked(conn, strings.TrimPrefix(topic, "tasks."), msg.Seq)
+				}
+			}
+			log.Printf("客户端订阅主题: %v", msg.Topics)
+		case "unsubscribe":
+			for _, topic := range msg.Topics {
+				delete(clientInfo.Topics, topic)
+			}
+			log.Printf("客户端取消订阅主题: %v", msg.Topics)
 		}
+		clientsMu.Unlock()
 	}
 }
 
-// 处理视频列表API请求
-func handleVideoList(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// 来源信息中用于搜索的字段（按来源信息文件的修改时间缓存，避免每次列表都读取完整的info json）
+type sourceSummary struct {
+	ModTime     time.Time
+	Title       string
+	Uploader    string
+	Description string
+	Extractor   string
+	ID          string
+	SourceURL   string
+}
 
-	// 获取排序参数
-	sortBy := r.URL.Query().Get("sort")
-	if sortBy == "" {
-		sortBy = "time" // 默认按创建时间排序
-	}
+var (
+	sourceSummaries   = make(map[string]sourceSummary) // 来源信息文件路径 -> 搜索字段
+	sourceSummariesMu sync.Mutex
+)
 
-	// 获取当前工作目录
-	cwd, err := os.Getwd()
+// 获取视频来源信息中的标题、上传者和简介，没有来源信息时返回nil
+func lookupSourceSummary(root, rel string) *sourceSummary {
+	metadataPath := metadataPathFor(root, rel)
+	info, err := os.Stat(metadataPath)
+
+	sourceSummariesMu.Lock()
+	defer sourceSummariesMu.Unlock()
 	if err != nil {
-		http.Error(w, "Failed to get working directory", http.StatusInternalServerError)
-		return
+		delete(sourceSummaries, metadataPath)
+		return nil
+	}
+	if cached, ok := sourceSummaries[metadataPath]; ok && cached.ModTime.Equal(info.ModTime()) {
+		return &cached
+	}
+	metadata, err := readSourceMetadata(root, rel)
+	if err != nil {
+		return nil
+	}
+	summary := sourceSummary{
+		ModTime:     info.ModTime(),
+		Title:       metadata.Title,
+		Uploader:    metadata.Uploader,
+		Description: metadata.Description,
+		Extractor:   metadata.Extractor,
+		ID:          metadata.ID,
+		SourceURL:   metadata.SourceURL,
+	}
+	sourceSummaries[metadataPath] = summary
+	return &summary
+}
+
+// 视频列表的筛选条件
+type videoListFilter struct {
+	Terms   []string        // 搜索关键词（全部匹配文件名、标题、上传者或简介之一）
+	Exts    map[string]bool // 扩展名，例如 .mp4
+	From    time.Time
+	To      time.Time
+	MinSize int64
+	MaxSize int64
+}
+
+// 解析文件大小参数，支持 K/M/G 单位，例如 500M、1.5G
+func parseSizeParam(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.TrimSuffix(value, "B")
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
 	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("无效的文件大小: %s", value)
+	}
+	return int64(number * multiplier), nil
+}
 
-	// 读取目录中的所有文件
-	entries, err := os.ReadDir(cwd)
+// 解析日期参数，支持 2006-01-02 和 RFC3339 格式；endOfDay为true时只有日期的值取当天结束
+func parseDateParam(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
 	if err != nil {
-		http.Error(w, "Failed to read directory", http.StatusInternalServerError)
-		return
+		return time.Time{}, fmt.Errorf("无效的日期: %s", value)
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
 	}
+	return t, nil
+}
 
-	videos := make([]VideoInfo, 0) // 初始化为空数组而不是nil切片
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
+// 从查询参数解析视频列表的筛选条件
+func parseVideoListFilter(query url.Values) (videoListFilter, error) {
+	var filter videoListFilter
+	filter.Terms = strings.Fields(strings.ToLower(query.Get("q")))
 
-		filename := entry.Name()
-		// 处理常见的视频文件格式，排除临时文件
-		lowerFilename := strings.ToLower(filename)
-		videoExtensions := []string{".mp4", ".webm", ".mkv", ".flv", ".avi", ".mov"}
-		isVideoFile := false
-		for _, ext := range videoExtensions {
-			if strings.HasSuffix(lowerFilename, ext) && !strings.Contains(filename, ext+".") {
-				isVideoFile = true
-				break
-			}
-		}
-		if isVideoFile {
-			info, err := entry.Info()
-			if err != nil {
+	if query.Get("ext") != "" {
+		filter.Exts = make(map[string]bool)
+		for _, ext := range strings.Split(query.Get("ext"), ",") {
+			ext = strings.ToLower(strings.TrimSpace(ext))
+			if ext == "" {
 				continue
 			}
-
-			videos = append(videos, VideoInfo{
-				Name:      filename,
-				Size:      info.Size(),
-				CreatedAt: info.ModTime(), // 使用修改时间作为创建时间
-			})
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			filter.Exts[ext] = true
 		}
 	}
 
-	// 根据排序参数进行排序
-	switch sortBy {
-	case "time":
-		// 按创建时间降序排序（最新的在前）
-		for i := 0; i < len(videos)-1; i++ {
-			for j := i + 1; j < len(videos); j++ {
-				if videos[i].CreatedAt.Before(videos[j].CreatedAt) {
-					videos[i], videos[j] = videos[j], videos[i]
-				}
-			}
+	var err error
+	if value := query.Get("from"); value != "" {
+		if filter.From, err = parseDateParam(value, false); err != nil {
+			return filter, err
 		}
-	case "size":
-		// 按文件大小降序排序（大文件在前）
-		for i := 0; i < len(videos)-1; i++ {
-			for j := i + 1; j < len(videos); j++ {
-				if videos[i].Size < videos[j].Size {
-					videos[i], videos[j] = videos[j], videos[i]
-				}
-			}
+	}
+	if value := query.Get("to"); value != "" {
+		if filter.To, err = parseDateParam(value, true); err != nil {
+			return filter, err
 		}
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	json.NewEncoder(w).Encode(videos)
+	if value := query.Get("minSize"); value != "" {
+		if filter.MinSize, err = parseSizeParam(value); err != nil {
+			return filter, err
+		}
+	}
+	if value := query.Get("maxSize"); value != "" {
+		if filter.MaxSize, err = parseSizeParam(value); err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
 }
 
-// 处理视频流API请求
-func handleVideoStream(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// 检查视频文件本身（扩展名、修改时间、大小）是否符合筛选条件
+func (f videoListFilter) matchFile(rel string, info fs.FileInfo) bool {
+	if f.Exts != nil && !f.Exts[strings.ToLower(path.Ext(rel))] {
+		return false
 	}
-
-	// 从URL路径中提取文件名
-	filename := strings.TrimPrefix(r.URL.Path, "/api/video/")
-	if filename == "" {
-		http.Error(w, "Filename not provided", http.StatusBadRequest)
-		return
+	if !f.From.IsZero() && info.ModTime().Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && info.ModTime().After(f.To) {
+		return false
 	}
+	if f.MinSize > 0 && info.Size() < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && info.Size() > f.MaxSize {
+		return false
+	}
+	return true
+}
 
-	// URL解码文件名
-	decodedFilename, err := url.QueryUnescape(filename)
-	if err != nil {
-		http.Error(w, "Invalid filename", http.StatusBadRequest)
-		return
+// 检查视频是否匹配全部搜索关键词
+func (f videoListFilter) matchText(video VideoInfo, summary *sourceSummary) bool {
+	if len(f.Terms) == 0 {
+		return true
+	}
+	fields := []string{strings.ToLower(video.Name)}
+	if summary != nil {
+		fields = append(fields, strings.ToLower(summary.Title), strings.ToLower(summary.Uploader), strings.ToLower(summary.Description))
+	}
+	for _, term := range f.Terms {
+		found := false
+		for _, field := range fields {
+			if strings.Contains(field, term) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
 	}
+	return true
+}
 
-	// 获取基础文件名，防止路径遍历攻击
-	decodedFilename = filepath.Base(decodedFilename)
+// 视频列表的排序键，也用作分页游标的内容
+type videoSortKey struct {
+	Sort    string `json:"s"`
+	Desc    bool   `json:"d,omitempty"`
+	Value   int64  `json:"v"`
+	Missing bool   `json:"m,omitempty"` // 尚未分析媒体信息，始终排在最后
+	Name    string `json:"n"`
+}
 
-	// 获取当前工作目录
-	cwd, err := os.Getwd()
-	if err != nil {
-		http.Error(w, "Failed to get working directory", http.StatusInternalServerError)
-		return
-	}
+// 视频列表支持的排序方式及默认方向（true为降序）
+var videoSortDefaults = map[string]bool{
+	"name":       false,
+	"time":       true,
+	"size":       true,
+	"duration":   true,
+	"resolution": true,
+}
 
-	// 构建完整文件路径
-	filePath := filepath.Join(cwd, decodedFilename)
+// 计算视频的排序键
+func videoSortKeyFor(video VideoInfo, sortBy string, desc bool) videoSortKey {
+	key := videoSortKey{Sort: sortBy, Desc: desc, Name: video.Name}
+	switch sortBy {
+	case "time":
+		key.Value = video.CreatedAt.UnixNano()
+	case "size":
+		key.Value = video.Size
+	case "duration":
+		key.Missing = video.Media == nil
+		key.Value = int64(mediaDuration(video.Media) * 1000)
+	case "resolution":
+		key.Missing = video.Media == nil
+		key.Value = int64(mediaPixels(video.Media))
+	}
+	return key
+}
 
-	// 检查文件是否为支持的视频格式
-	lowerFilename := strings.ToLower(decodedFilename)
-	videoExtensions := []string{".mp4", ".webm", ".mkv", ".flv", ".avi", ".mov"}
-	isVideoFile := false
-	for _, ext := range videoExtensions {
-		if strings.HasSuffix(lowerFilename, ext) {
-			isVideoFile = true
-			break
+// 比较两个排序键，值相同时按名称排序，保证顺序稳定以便分页
+func lessVideoSortKey(a, b videoSortKey) bool {
+	if a.Missing != b.Missing {
+		return b.Missing
+	}
+	if a.Value != b.Value {
+		if a.Desc {
+			return a.Value > b.Value
 		}
+		return a.Value < b.Value
 	}
-	if !isVideoFile {
-		http.Error(w, "Invalid file type", http.StatusBadRequest)
-		return
+	if a.Desc {
+		return a.Name > b.Name
 	}
+	return a.Name < b.Name
+}
 
-	// 检查文件是否存在
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		http.Error(w, "File not found", http.StatusNotFound)
-		return
-	}
+// 按排序键同时排序视频和排序键
+type videoSorter struct {
+	videos []VideoInfo
+	keys   []videoSortKey
+}
 
-	// 根据文件扩展名设置正确的MIME类型
-	var contentType string
-	switch {
-	case strings.HasSuffix(lowerFilename, ".mp4"):
-		contentType = "video/mp4"
-	case strings.HasSuffix(lowerFilename, ".webm"):
-		contentType = "video/webm"
-	case strings.HasSuffix(lowerFilename, ".mkv"):
-		contentType = "video/x-matroska"
-	case strings.HasSuffix(lowerFilename, ".flv"):
-		contentType = "video/x-flv"
-	case strings.HasSuffix(lowerFilename, ".avi"):
-		contentType = "video/x-msvideo"
-	case strings.HasSuffix(lowerFilename, ".mov"):
-		contentType = "video/quicktime"
-	default:
-		contentType = "video/mp4" // 默认MIME类型
-	}
+func (s videoSorter) Len() int           { return len(s.videos) }
+func (s videoSorter) Less(i, j int) bool { return lessVideoSortKey(s.keys[i], s.keys[j]) }
+func (s videoSorter) Swap(i, j int) {
+	s.videos[i], s.videos[j] = s.videos[j], s.videos[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
 
-	// 设置响应头
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Accept-Ranges", "bytes")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+// 编码分页游标
+func encodeVideoCursor(key videoSortKey) string {
+	data, _ := json.Marshal(key)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
 
-	// 提供文件服务
-	http.ServeFile(w, r, filePath)
+// 解码分页游标，游标必须来自相同的排序方式
+func decodeVideoCursor(cursor, sortBy string, desc bool) (videoSortKey, error) {
+	var key videoSortKey
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return key, fmt.Errorf("无效的游标")
+	}
+	if err := json.Unmarshal(data, &key); err != nil {
+		return key, fmt.Errorf("无效的游标")
+	}
+	if key.Sort != sortBy || key.Desc != desc {
+		return key, fmt.Errorf("游标与排序方式不一致")
+	}
+	return key, nil
 }
 
-// 处理需要转码的视频流
-func handleVideoTranscode(w http.ResponseWriter, r *http.Request) {
+// 处理视频列表API请求
+func handleVideoList(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// 从URL路径中提取文件名
-	filename := strings.TrimPrefix(r.URL.Path, "/api/video-transcode/")
-	if filename == "" {
-		http.Error(w, "Filename not provided", http.StatusBadRequest)
+	query := r.URL.Query()
+
+	// 获取排序参数
+	sortBy := query.Get("sort")
+	if sortBy == "" {
+		sortBy = "time" // 默认按创建时间排序
+	}
+	desc, ok := videoSortDefaults[sortBy]
+	if !ok {
+		http.Error(w, "Invalid sort", http.StatusBadRequest)
 		return
 	}
-
-	// URL解码文件名
-	decodedFilename, err := url.QueryUnescape(filename)
-	if err != nil {
-		http.Error(w, "Invalid filename", http.StatusBadRequest)
+	switch query.Get("order") {
+	case "":
+	case "asc":
+		desc = false
+	case "desc":
+		desc = true
+	default:
+		http.Error(w, "Invalid order", http.StatusBadRequest)
 		return
 	}
 
-	// 获取基础文件名，防止路径遍历攻击
-	decodedFilename = filepath.Base(decodedFilename)
-
-	// 获取当前工作目录
-	cwd, err := os.Getwd()
+	// 获取筛选条件
+	filter, err := parseVideoListFilter(query)
 	if err != nil {
-		http.Error(w, "Failed to get working directory", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// 构建完整文件路径
-	filePath := filepath.Join(cwd, decodedFilename)
-
-	// 检查文件是否存在
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		http.Error(w, "File not found", http.StatusNotFound)
-		return
+	// 获取分页参数：limit为0表示不分页，cursor优先于offset
+	limit, offset := 0, 0
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
 	}
-
-	// 检查ffmpeg是否存在
-	ffmpegPath := getExecutablePath("ffmpeg")
-	if _, err := os.Stat(ffmpegPath); os.IsNotExist(err) {
-		http.Error(w, "FFmpeg not found", http.StatusInternalServerError)
-		return
+	if value := query.Get("offset"); value != "" {
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
 	}
-
+	var cursor *videoSortKey
+	if value := query.Get("cursor"); value != "" {
+		key, err := decodeVideoCursor(value, sortBy, desc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cursor = &key
+	}
+
+	// 获取视频库根目录
+	root := getLibraryRoot()
+
+	// 只列出指定目录（包含子目录）中的视频
+	folder := ""
+	if query.Get("folder") != "" {
+		if _, folder, err = resolveLibraryPath(root, query.Get("folder")); err != nil {
+			http.Error(w, "Invalid folder", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// 只列出指定类型的文件，例如 kind=audio 或 kind=video,audio
+	var kinds map[string]bool
+	if query.Get("kind") != "" {
+		kinds = make(map[string]bool)
+		for _, kind := range strings.Split(query.Get("kind"), ",") {
+			kinds[strings.TrimSpace(kind)] = true
+		}
+	}
+
+	// 递归读取视频库中的所有视频、音频和字幕文件
+	var files []libraryFile
+	err = walkLibrary(root, folder, func(rel string, entry fs.DirEntry) error {
+		// 排除临时文件和不支持的格式
+		kind := mediaKindOf(entry.Name())
+		if entry.IsDir() || kind == "" {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, libraryFile{Rel: rel, Info: info, Kind: kind})
+		return nil
+	})
+	if err != nil {
+		if os.IsNotExist(err) && folder != "" {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+			return
+		}
+		if !os.IsNotExist(err) {
+			http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// 字幕和分开下载的音频作为视频的关联文件，不单独列出
+	primary, related := groupLibraryFiles(files)
+	videos := make([]VideoInfo, 0) // 初始化为空数组而不是nil切片
+	for _, file := range primary {
+		if kinds != nil && !kinds[file.Kind] {
+			continue
+		}
+		if !filter.matchFile(file.Rel, file.Info) {
+			continue
+		}
+
+		// 按媒体信息筛选（分辨率、时长、编码），字幕文件没有媒体信息
+		var media *MediaInfo
+		if file.Kind != MediaKindSubtitle {
+			media = lookupMediaInfo(filepath.Join(root, filepath.FromSlash(file.Rel)), file.Info)
+		}
+		if !matchMediaFilters(media, query) {
+			continue
+		}
+
+		video := VideoInfo{
+			Name:      file.Rel,
+			Size:      file.Info.Size(),
+			CreatedAt: file.Info.ModTime(), // 使用修改时间作为创建时间
+			Media:     media,
+			Kind:      file.Kind,
+			Related:   related[file.Rel],
+		}
+		// 按文件名和来源信息搜索
+		summary := lookupSourceSummary(root, file.Rel)
+		if !filter.matchText(video, summary) {
+			continue
+		}
+		if summary != nil {
+			video.Title = summary.Title
+			video.Uploader = summary.Uploader
+		}
+		videos = append(videos, video)
+	}
+
+	// 根据排序参数进行排序（值相同时按名称排序）
+	keys := make([]videoSortKey, len(videos))
+	for i := range videos {
+		keys[i] = videoSortKeyFor(videos[i], sortBy, desc)
+	}
+	sort.Sort(videoSorter{videos: videos, keys: keys})
+
+	// 分页：游标指向上一页的最后一个视频
+	total := len(videos)
+	start := offset
+	if cursor != nil {
+		start = sort.Search(len(keys), func(i int) bool {
+			return lessVideoSortKey(*cursor, keys[i])
+		})
+	}
+	if start > len(videos) {
+		start = len(videos)
+	}
+	end := len(videos)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+	if end < len(videos) && end > start {
+		w.Header().Set("X-Next-Cursor", encodeVideoCursor(keys[end-1]))
+	}
+	videos = videos[start:end]
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count, X-Next-Cursor")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(videos)
+}
+
+// 视频库中支持的视频格式
+var videoExtensions = []string{".mp4", ".webm", ".mkv", ".flv", ".avi", ".mov"}
+
+// 视频库根目录下保存缩略图的目录，扫描时忽略
+const thumbnailsDirName = "thumbnails"
+
+// 检查文件名是否为支持的视频格式（排除 xxx.mp4.part 之类的临时文件）
+func isVideoFile(filename string) bool {
+	return hasLibraryExtension(filename, videoExtensions)
+}
+
+// 视频库中支持的音频和字幕格式
+var (
+	audioExtensions    = []string{".mp3", ".m4a", ".wav", ".opus"}
+	subtitleExtensions = []string{".srt", ".vtt", ".ass"}
+)
+
+// 视频库中的媒体类型
+const (
+	MediaKindVideo    = "video"
+	MediaKindAudio    = "audio"
+	MediaKindSubtitle = "subtitle"
+)
+
+// 检查文件名是否以指定扩展名之一结尾（排除 xxx.mp4.part 之类的临时文件）
+func hasLibraryExtension(filename string, extensions []string) bool {
+	lowerFilename := strings.ToLower(filename)
+	for _, ext := range extensions {
+		if strings.HasSuffix(lowerFilename, ext) && !strings.Contains(filename, ext+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// 获取文件的媒体类型，不是视频库支持的格式时返回空
+func mediaKindOf(filename string) string {
+	switch {
+	case isVideoFile(filename):
+		return MediaKindVideo
+	case hasLibraryExtension(filename, audioExtensions):
+		return MediaKindAudio
+	case hasLibraryExtension(filename, subtitleExtensions):
+		return MediaKindSubtitle
+	}
+	return ""
+}
+
+// 检查是否为视频库可以管理的媒体文件（普通文件且为支持的格式），目录和程序文件不能重命名或删除
+func isLibraryMediaFile(rel string, info fs.FileInfo) bool {
+	return info.Mode().IsRegular() && mediaKindOf(rel) != ""
+}
+
+// 字幕文件名中的语言后缀，例如 "xxx.en.srt"、"xxx.zh-Hans.vtt"
+var subtitleLanguageRe = regexp.MustCompile(`^[A-Za-z]{2,3}([-_][A-Za-z0-9]{2,8})*$`)
+
+// 视频的关联文件（同名字幕、单独下载的音频）
+type RelatedAsset struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Size     int64  `json:"size"`
+	Language string `json:"language,omitempty"` // 字幕语言
+}
+
+// 视频库中扫描到的文件
+type libraryFile struct {
+	Rel  string
+	Info fs.FileInfo
+	Kind string
+}
+
+// 把同名字幕和单独下载的音频归入对应的视频（没有视频时字幕归入音频），返回主条目及其关联文件
+func groupLibraryFiles(files []libraryFile) ([]libraryFile, map[string][]RelatedAsset) {
+	// 按目录和基础名称索引视频和音频
+	owners := make(map[string]string)
+	for _, kind := range []string{MediaKindAudio, MediaKindVideo} {
+		for _, file := range files {
+			if file.Kind == kind {
+				owners[downloadStem(file.Rel)] = file.Rel
+			}
+		}
+	}
+
+	related := make(map[string][]RelatedAsset)
+	grouped := make(map[string]bool)
+	for _, file := range files {
+		asset := RelatedAsset{Name: file.Rel, Kind: file.Kind, Size: file.Info.Size()}
+		owner := ""
+		switch file.Kind {
+		case MediaKindAudio:
+			// 分开下载的音频，例如 "xxx.f140.m4a" 对应 "xxx.mp4"
+			if candidate := owners[downloadStem(file.Rel)]; candidate != file.Rel && mediaKindOf(candidate) == MediaKindVideo {
+				owner = candidate
+			}
+		case MediaKindSubtitle:
+			stem := strings.TrimSuffix(file.Rel, path.Ext(file.Rel))
+			if candidate, ok := owners[stem]; ok {
+				owner = candidate
+			} else if ext := path.Ext(stem); ext != "" && subtitleLanguageRe.MatchString(ext[1:]) {
+				if candidate, ok := owners[strings.TrimSuffix(stem, ext)]; ok {
+					owner = candidate
+					asset.Language = ext[1:]
+				}
+			}
+		}
+		if owner != "" {
+			related[owner] = append(related[owner], asset)
+			grouped[file.Rel] = true
+		}
+	}
+
+	primary := make([]libraryFile, 0, len(files)-len(grouped))
+	for _, file := range files {
+		if !grouped[file.Rel] {
+			primary = append(primary, file)
+		}
+	}
+	return primary, related
+}
+
+// 获取音频文件的MIME类型
+func audioContentType(filename string) string {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".mp3":
+		return "audio/mpeg"
+	case ".m4a":
+		return "audio/mp4"
+	case ".wav":
+		return "audio/wav"
+	case ".opus":
+		return "audio/ogg" // yt-dlp输出的opus文件使用ogg容器
+	}
+	return "application/octet-stream"
+}
+
+// 获取字幕文件的MIME类型
+func subtitleContentType(filename string) string {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".vtt":
+		return "text/vtt; charset=utf-8"
+	case ".srt":
+		return "application/x-subrip; charset=utf-8"
+	case ".ass":
+		return "text/x-ssa; charset=utf-8"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// SRT时间戳中的毫秒分隔符，例如 "00:00:01,500"
+var srtTimestampRe = regexp.MustCompile(`(\d{2}:\d{2}:\d{2}),(\d{3})`)
+
+// 将SRT字幕转换为浏览器<track>可以使用的WebVTT格式
+func srtToWebVTT(data []byte) []byte {
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = srtTimestampRe.ReplaceAllString(text, "$1.$2")
+	return []byte("WEBVTT\n\n" + text)
+}
+
+// 处理音频流API请求
+func handleAudioStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 从URL路径中提取相对视频库根目录的文件路径
+	decodedFilename, err := libraryPathFromURL(r, "/api/audio/")
+	if err != nil {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	if decodedFilename == "" {
+		http.Error(w, "Filename not provided", http.StatusBadRequest)
+		return
+	}
+
+	filePath, rel, err := resolveLibraryPath(getLibraryRoot(), decodedFilename)
+	if err != nil {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	if mediaKindOf(decodedFilename) != MediaKindAudio {
+		http.Error(w, "Invalid file type", http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	recordWatched(rel)
+	w.Header().Set("Content-Type", audioContentType(decodedFilename))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	http.ServeFile(w, r, filePath)
+}
+
+// 处理字幕文件请求，?format=vtt 时把SRT转换为WebVTT
+func handleSubtitle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	decodedFilename, err := libraryPathFromURL(r, "/api/subtitle/")
+	if err != nil {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	if decodedFilename == "" {
+		http.Error(w, "Filename not provided", http.StatusBadRequest)
+		return
+	}
+
+	filePath, _, err := resolveLibraryPath(getLibraryRoot(), decodedFilename)
+	if err != nil {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	if mediaKindOf(decodedFilename) != MediaKindSubtitle {
+		http.Error(w, "Invalid file type", http.StatusBadRequest)
+		return
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "File not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	contentType := subtitleContentType(decodedFilename)
+	if r.URL.Query().Get("format") == "vtt" {
+		switch strings.ToLower(path.Ext(decodedFilename)) {
+		case ".srt":
+			data = srtToWebVTT(data)
+			contentType = subtitleContentType(".vtt")
+		case ".vtt":
+		default:
+			http.Error(w, "Conversion not supported", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(data)
+}
+
+// 检查视频库中的文件或目录是否需要忽略：隐藏文件、缩略图目录以及设置中的忽略规则
+func isLibraryIgnored(rel string, patterns []string) bool {
+	name := path.Base(rel)
+	if strings.HasPrefix(name, ".") || rel == thumbnailsDirName {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, rel); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// 遍历视频库中的文件，rel为使用/分隔的相对路径；start为开始遍历的相对目录，为空时从根目录开始
+func walkLibrary(root, start string, fn func(rel string, entry fs.DirEntry) error) error {
+	currentSettings := getSettings()
+	startPath := filepath.Join(root, filepath.FromSlash(start))
+	return filepath.WalkDir(startPath, func(fullPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// 无法读取的子目录直接跳过
+			if fullPath != startPath {
+				return nil
+			}
+			return err
+		}
+		relPath, err := filepath.Rel(root, fullPath)
+		if err != nil || relPath == "." {
+			return nil
+		}
+		rel := filepath.ToSlash(relPath)
+		if isLibraryIgnored(rel, currentSettings.LibraryIgnore) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			// 深度从根目录的子目录开始计算为1
+			if strings.Count(rel, "/")+1 > currentSettings.LibraryMaxDepth {
+				return filepath.SkipDir
+			}
+		}
+		return fn(rel, entry)
+	})
+}
+
+// 将请求中的相对路径解析为视频库中的绝对路径，拒绝越出视频库根目录、隐藏或被忽略的路径
+func resolveLibraryPath(root, name string) (string, string, error) {
+	rel := strings.Trim(strings.ReplaceAll(name, "\\", "/"), "/")
+	if rel == "" || strings.ContainsRune(rel, 0) {
+		return "", "", fmt.Errorf("无效的路径")
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if part == ".." {
+			return "", "", fmt.Errorf("无效的路径")
+		}
+	}
+	rel = path.Clean(rel)
+	if rel == "." {
+		return "", "", fmt.Errorf("无效的路径")
+	}
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		if isLibraryIgnored(strings.Join(parts[:i+1], "/"), getSettings().LibraryIgnore) {
+			return "", "", fmt.Errorf("无效的路径")
+		}
+	}
+
+	fullPath := filepath.Join(root, filepath.FromSlash(rel))
+
+	// 已存在的上级目录不能通过符号链接指向视频库之外
+	if realRoot, err := filepath.EvalSymlinks(root); err == nil {
+		if realDir, err := filepath.EvalSymlinks(filepath.Dir(fullPath)); err == nil {
+			if inside, err := filepath.Rel(realRoot, realDir); err != nil || inside == ".." || strings.HasPrefix(inside, ".."+string(filepath.Separator)) {
+				return "", "", fmt.Errorf("无效的路径")
+			}
+		}
+	}
+	return fullPath, rel, nil
+}
+
+// 从请求URL中取出前缀之后的路径参数（视频库相对路径、任务ID等），只解码一次
+func libraryPathFromURL(r *http.Request, prefix string) (string, error) {
+	return url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), prefix))
+}
+
+// 获取视频文件对应的缩略图路径（缩略图目录中保持与视频库相同的目录结构）
+func thumbnailPathFor(root, rel string) string {
+	thumbnailName := strings.TrimSuffix(path.Base(rel), path.Ext(rel)) + "_thumbnail.jpg"
+	return filepath.Join(root, thumbnailsDirName, filepath.FromSlash(path.Dir(rel)), thumbnailName)
+}
+
+// 视频库目录树节点
+type FolderNode struct {
+	Name     string        `json:"name"`
+	Path     string        `json:"path"`   // 相对视频库根目录的路径，根目录为空
+	Videos   int           `json:"videos"` // 该目录中的视频数量（不含子目录）
+	Children []*FolderNode `json:"children"`
+}
+
+// 处理视频库目录树请求
+func handleFolderTree(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	root := getLibraryRoot()
+	tree := &FolderNode{Name: filepath.Base(root), Path: "", Children: []*FolderNode{}}
+	nodes := map[string]*FolderNode{"": tree}
+
+	err := walkLibrary(root, "", func(rel string, entry fs.DirEntry) error {
+		parent := nodes[path.Dir(rel)]
+		if path.Dir(rel) == "." {
+			parent = tree
+		}
+		if parent == nil {
+			return nil
+		}
+		if entry.IsDir() {
+			node := &FolderNode{Name: entry.Name(), Path: rel, Children: []*FolderNode{}}
+			nodes[rel] = node
+			parent.Children = append(parent.Children, node)
+		} else if isVideoFile(entry.Name()) {
+			parent.Videos++
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(tree)
+}
+
+// 媒体信息（由ffprobe分析得到）
+type MediaInfo struct {
+	Duration    float64      `json:"duration"` // 秒
+	Width       int          `json:"width"`
+	Height      int          `json:"height"`
+	VideoCodec  string       `json:"videoCodec"`
+	AudioCodec  string       `json:"audioCodec"`
+	Bitrate     int64        `json:"bitrate"` // 比特/秒
+	FPS         float64      `json:"fps"`
+	Container   string       `json:"container"`
+	AudioTracks []MediaTrack `json:"audioTracks"`
+	Subtitles   []MediaTrack `json:"subtitles"`
+}
+
+// 音轨或字幕流信息
+type MediaTrack struct {
+	Index    int    `json:"index"`
+	Codec    string `json:"codec"`
+	Language string `json:"language,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Channels int    `json:"channels,omitempty"`
+}
+
+// 媒体索引条目，文件大小或修改时间变化后重新分析
+type mediaIndexEntry struct {
+	Size    int64      `json:"size"`
+	ModTime time.Time  `json:"modTime"`
+	Media   *MediaInfo `json:"media,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// ffprobe -print_format json 的输出
+type ffprobeOutput struct {
+	Streams []struct {
+		Index        int               `json:"index"`
+		CodecType    string            `json:"codec_type"`
+		CodecName    string            `json:"codec_name"`
+		Width        int               `json:"width"`
+		Height       int               `json:"height"`
+		AvgFrameRate string            `json:"avg_frame_rate"`
+		RFrameRate   string            `json:"r_frame_rate"`
+		Channels     int               `json:"channels"`
+		Tags         map[string]string `json:"tags"`
+		Disposition  struct {
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+	} `json:"streams"`
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+var (
+	mediaIndex      = make(map[string]*mediaIndexEntry) // 媒体索引，键为文件的绝对路径
+	mediaPending    = make(map[string]bool)             // 等待分析的文件
+	mediaIndexMu    sync.Mutex                          // 保护mediaIndex和mediaPending的互斥锁
+	mediaProbeQueue = make(chan string, 4096)           // 等待ffprobe分析的文件队列
+)
+
+// 解析ffprobe输出的帧率，例如 "30000/1001"
+func parseFrameRate(value string) float64 {
+	parts := strings.SplitN(value, "/", 2)
+	num, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0
+	}
+	if len(parts) == 2 {
+		den, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || den == 0 {
+			return 0
+		}
+		num /= den
+	}
+	return math.Round(num*100) / 100
+}
+
+// 运行ffprobe分析媒体文件
+func probeMediaFile(filePath string) (*MediaInfo, error) {
+	ffprobePath := getExecutablePath("ffprobe")
+	if _, err := os.Stat(ffprobePath); err != nil {
+		return nil, fmt.Errorf("ffprobe not found")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, ffprobePath, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", filePath)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed: %v", err)
+	}
+
+	var probe ffprobeOutput
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %v", err)
+	}
+
+	media := &MediaInfo{
+		AudioTracks: []MediaTrack{},
+		Subtitles:   []MediaTrack{},
+	}
+	media.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	media.Bitrate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+
+	// 容器格式优先使用与扩展名一致的名称，例如 "mov,mp4,m4a,3gp,3g2,mj2" -> "mp4"
+	formatNames := strings.Split(probe.Format.FormatName, ",")
+	media.Container = formatNames[0]
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(filePath)), ".")
+	for _, name := range formatNames {
+		if name == ext {
+			media.Container = name
+		}
+	}
+
+	for _, stream := range probe.Streams {
+		switch stream.CodecType {
+		case "video":
+			// 跳过封面图片，只记录第一个视频流
+			if stream.Disposition.AttachedPic == 1 || media.VideoCodec != "" {
+				continue
+			}
+			media.VideoCodec = stream.CodecName
+			media.Width = stream.Width
+			media.Height = stream.Height
+			media.FPS = parseFrameRate(stream.AvgFrameRate)
+			if media.FPS == 0 {
+				media.FPS = parseFrameRate(stream.RFrameRate)
+			}
+		case "audio":
+			if media.AudioCodec == "" {
+				media.AudioCodec = stream.CodecName
+			}
+			media.AudioTracks = append(media.AudioTracks, MediaTrack{
+				Index:    stream.Index,
+				Codec:    stream.CodecName,
+				Language: stream.Tags["language"],
+				Title:    stream.Tags["title"],
+				Channels: stream.Channels,
+			})
+		case "subtitle":
+			media.Subtitles = append(media.Subtitles, MediaTrack{
+				Index:    stream.Index,
+				Codec:    stream.CodecName,
+				Language: stream.Tags["language"],
+				Title:    stream.Tags["title"],
+			})
+		}
+	}
+	return media, nil
+}
+
+// 加载媒体索引文件
+func loadMediaIndex() {
+	data, err := os.ReadFile(mediaIndexFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取媒体索引失败: %v", err)
+		}
+		return
+	}
+
+	loaded := make(map[string]*mediaIndexEntry)
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		log.Printf("解析媒体索引失败: %v", err)
+		return
+	}
+
+	mediaIndexMu.Lock()
+	mediaIndex = loaded
+	mediaIndexMu.Unlock()
+}
+
+// 保存媒体索引，删除已不存在的文件（调用时需持有mediaIndexMu）
+func saveMediaIndexLocked() {
+	for filePath := range mediaIndex {
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			delete(mediaIndex, filePath)
+		}
+	}
+
+	data, err := json.Marshal(mediaIndex)
+	if err != nil {
+		log.Printf("序列化媒体索引失败: %v", err)
+		return
+	}
+	tmpFile := mediaIndexFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		log.Printf("保存媒体索引失败: %v", err)
+		return
+	}
+	if err := os.Rename(tmpFile, mediaIndexFile); err != nil {
+		log.Printf("保存媒体索引失败: %v", err)
+	}
+}
+
+// 查找文件的媒体信息，索引中没有或文件已变化时加入后台分析队列并返回nil
+func lookupMediaInfo(filePath string, info fs.FileInfo) *MediaInfo {
+	mediaIndexMu.Lock()
+	defer mediaIndexMu.Unlock()
+
+	if entry, ok := mediaIndex[filePath]; ok && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+		return entry.Media
+	}
+	enqueueMediaProbeLocked(filePath)
+	return nil
+}
+
+// 将文件加入ffprobe分析队列（调用时需持有mediaIndexMu）
+func enqueueMediaProbeLocked(filePath string) {
+	if mediaPending[filePath] {
+		return
+	}
+	select {
+	case mediaProbeQueue <- filePath:
+		mediaPending[filePath] = true
+	default:
+		// 队列已满，下次访问时再加入
+	}
+}
+
+// 将文件加入ffprobe分析队列
+func enqueueMediaProbe(filePath string) {
+	mediaIndexMu.Lock()
+	enqueueMediaProbeLocked(filePath)
+	mediaIndexMu.Unlock()
+}
+
+// 后台逐个分析队列中的文件，队列清空后保存索引
+func runMediaIndexer() {
+	for filePath := range mediaProbeQueue {
+		entry := &mediaIndexEntry{}
+		info, err := os.Stat(filePath)
+		if err == nil {
+			entry.Size = info.Size()
+			entry.ModTime = info.ModTime()
+			entry.Media, err = probeMediaFile(filePath)
+			if err != nil {
+				entry.Error = err.Error()
+			}
+		}
+
+		mediaIndexMu.Lock()
+		delete(mediaPending, filePath)
+		if info != nil {
+			// 没有ffprobe时不记录结果，安装后重新分析
+			if entry.Media != nil || entry.Error != "ffprobe not found" {
+				mediaIndex[filePath] = entry
+			}
+		}
+		if len(mediaProbeQueue) == 0 {
+			saveMediaIndexLocked()
+		}
+		mediaIndexMu.Unlock()
+	}
+}
+
+// 扫描视频库，将索引中没有或已变化的文件加入分析队列，缺少缩略图或缩略图已过期的视频加入缩略图生成队列
+func scanLibraryMedia() {
+	root := getLibraryRoot()
+	walkLibrary(root, "", func(rel string, entry fs.DirEntry) error {
+		if entry.IsDir() || (!isVideoFile(entry.Name()) && mediaKindOf(entry.Name()) != MediaKindAudio) {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			lookupMediaInfo(filepath.Join(root, filepath.FromSlash(rel)), info)
+			if isVideoFile(entry.Name()) && !cacheIsFresh(thumbnailPathFor(root, rel), info) {
+				enqueueThumbnail(root, rel)
+			}
+		}
+		return nil
+	})
+}
+
+// 视频库文件监视：定期扫描视频库，把程序之外的变化（其他程序添加、删除、重命名或修改文件）推送给订阅了library主题的客户端
+type watchedFile struct {
+	Info    fs.FileInfo
+	Pending bool // 新出现或已变化的文件正在等待写入完成
+	New     bool // 新出现的文件，写入完成前还没有推送过
+}
+
+var (
+	watchedFiles = make(map[string]*watchedFile) // 上次扫描到的文件（相对路径 -> 状态）
+	watchedRoot  string                          // 上次扫描的视频库根目录
+	watchMu      sync.Mutex                      // 保护watchedFiles和watchedRoot的互斥锁
+)
+
+// 文件大小和修改时间保持不变超过这个时间后才认为已写入完成
+const librarySettleTime = 3 * time.Second
+
+// yt-dlp下载过程中的中间文件，例如 "xxx.f137.mp4"、"xxx.temp.mp4"
+var intermediateFileRe = regexp.MustCompile(`\.(f(\d+|hls|dash|http)[\w-]*|temp)\.\w+$`)
+
+// 发布视频库变化并更新监视状态，避免下次扫描时重复推送程序自身造成的变化
+func publishLibraryEvent(event LibraryEvent) {
+	invalidateLibraryIDIndex()
+	root := getLibraryRoot()
+	watchMu.Lock()
+	if root == watchedRoot {
+		if event.OldName != "" {
+			delete(watchedFiles, event.OldName)
+		}
+		if event.Action == "removed" {
+			delete(watchedFiles, event.Name)
+		} else if info, err := os.Stat(filepath.Join(root, filepath.FromSlash(event.Name))); err == nil {
+			watchedFiles[event.Name] = &watchedFile{Info: info}
+		}
+	}
+	watchMu.Unlock()
+
+	publishTopic(TopicLibrary, "library", event)
+}
+
+// 检查是否有正在运行的下载任务
+func hasRunningJobs() bool {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, job := range jobs {
+		if job.Status == JobRunning {
+			return true
+		}
+	}
+	return false
+}
+
+// 扫描一次视频库并返回与上次扫描相比的变化
+func scanLibraryChanges() []LibraryEvent {
+	root := getLibraryRoot()
+	downloading := hasRunningJobs()
+	current := make(map[string]fs.FileInfo)
+	walkLibrary(root, "", func(rel string, entry fs.DirEntry) error {
+		if entry.IsDir() || mediaKindOf(entry.Name()) == "" {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			current[rel] = info
+		}
+		return nil
+	})
+
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	// 首次扫描或视频库根目录变化时只记录当前状态
+	if root != watchedRoot {
+		watchedRoot = root
+		watchedFiles = make(map[string]*watchedFile, len(current))
+		for rel, info := range current {
+			watchedFiles[rel] = &watchedFile{Info: info}
+		}
+		return nil
+	}
+
+	// 消失的文件（还没有推送过的新文件直接忽略）
+	removed := make(map[string]fs.FileInfo)
+	for rel, file := range watchedFiles {
+		if _, ok := current[rel]; !ok {
+			if !file.New {
+				removed[rel] = file.Info
+			}
+			delete(watchedFiles, rel)
+		}
+	}
+
+	var events []LibraryEvent
+	for rel, info := range current {
+		file, known := watchedFiles[rel]
+		if known && !file.Pending && file.Info.Size() == info.Size() && file.Info.ModTime().Equal(info.ModTime()) {
+			continue
+		}
+
+		// 与消失的文件是同一个文件时视为重命名（重命名不需要等待写入完成）
+		if !known {
+			renamedFrom := ""
+			for oldRel, oldInfo := range removed {
+				if os.SameFile(oldInfo, info) || (oldInfo.Size() == info.Size() && oldInfo.ModTime().Equal(info.ModTime())) {
+					renamedFrom = oldRel
+					break
+				}
+			}
+			if renamedFrom != "" {
+				delete(removed, renamedFrom)
+				watchedFiles[rel] = &watchedFile{Info: info}
+				events = append(events, LibraryEvent{Action: "renamed", Name: rel, OldName: renamedFrom})
+				continue
+			}
+		}
+
+		// 等待文件写入完成：大小和修改时间在两次扫描之间没有变化，且修改时间已超过librarySettleTime；
+		// 有下载任务运行时yt-dlp的中间文件也不推送
+		stable := known && file.Pending && file.Info.Size() == info.Size() && file.Info.ModTime().Equal(info.ModTime())
+		if !stable || time.Since(info.ModTime()) < librarySettleTime || (downloading && intermediateFileRe.MatchString(rel)) {
+			if known {
+				file.Info = info
+				file.Pending = true
+			} else {
+				watchedFiles[rel] = &watchedFile{Info: info, Pending: true, New: true}
+			}
+			continue
+		}
+
+		action := "modified"
+		if file.New {
+			action = "added"
+		}
+		file.Pending = false
+		file.New = false
+		events = append(events, LibraryEvent{Action: action, Name: rel})
+	}
+
+	for rel := range removed {
+		events = append(events, LibraryEvent{Action: "removed", Name: rel})
+	}
+	return events
+}
+
+// 定期扫描视频库并推送变化，新增或修改的文件同时加入媒体信息分析队列和缩略图生成队列
+func runLibraryWatcher() {
+	for {
+		interval := getSettings().LibraryWatchInterval
+		if interval <= 0 {
+			// 已关闭监视，下次开启时重新记录当前状态
+			watchMu.Lock()
+			watchedRoot = ""
+			watchMu.Unlock()
+			time.Sleep(10 * time.Second)
+			continue
+		}
+
+		for _, event := range scanLibraryChanges() {
+			log.Printf("视频库变化: %s %s", event.Action, event.Name)
+			invalidateLibraryIDIndex()
+			if event.Action == "renamed" {
+				// 在程序外改名时，同样迁移旧文件名的索引和元数据
+				moveLibraryEntries(getLibraryRoot(), event.OldName, event.Name)
+			}
+			publishTopic(TopicLibrary, "library", event)
+			if event.Action != "removed" && mediaKindOf(event.Name) != MediaKindSubtitle {
+				enqueueMediaProbe(filepath.Join(getLibraryRoot(), filepath.FromSlash(event.Name)))
+			}
+			if isVideoFile(event.Name) {
+				switch event.Action {
+				case "modified":
+					// 文件内容变化，旧的缩略图和雪碧图不再有效
+					invalidateThumbnails(getLibraryRoot(), event.Name)
+				case "added", "renamed":
+					enqueueThumbnail(getLibraryRoot(), event.Name)
+				}
+			}
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+// 获取视频时长，没有媒体信息时返回-1
+func mediaDuration(media *MediaInfo) float64 {
+	if media == nil {
+		return -1
+	}
+	return media.Duration
+}
+
+// 获取视频像素数，没有媒体信息时返回-1
+func mediaPixels(media *MediaInfo) int {
+	if media == nil {
+		return -1
+	}
+	return media.Width * media.Height
+}
+
+// 重命名文件后同步更新媒体索引
+func renameMediaIndexEntry(oldPath, newPath string) {
+	mediaIndexMu.Lock()
+	if entry, ok := mediaIndex[oldPath]; ok {
+		delete(mediaIndex, oldPath)
+		mediaIndex[newPath] = entry
+	}
+	mediaIndexMu.Unlock()
+}
+
+// 解析分辨率筛选参数，例如 "4k"、"1080p"、"720"，返回最小高度
+func parseResolutionFilter(value string) int {
+	switch strings.ToLower(value) {
+	case "8k":
+		return 4320
+	case "4k", "uhd":
+		return 2160
+	case "2k":
+		return 1440
+	case "fhd":
+		return 1080
+	case "hd":
+		return 720
+	}
+	height, _ := strconv.Atoi(strings.TrimSuffix(strings.ToLower(value), "p"))
+	return height
+}
+
+// 检查视频是否符合媒体信息的筛选条件，例如 resolution=4k、minDuration=3600、codec=!h264
+func matchMediaFilters(media *MediaInfo, query url.Values) bool {
+	resolution, minDuration, maxDuration, codec := query.Get("resolution"), query.Get("minDuration"), query.Get("maxDuration"), query.Get("codec")
+	if resolution == "" && minDuration == "" && maxDuration == "" && codec == "" {
+		return true
+	}
+	// 尚未分析的文件不参与媒体筛选
+	if media == nil {
+		return false
+	}
+
+	if resolution != "" && media.Height < parseResolutionFilter(resolution) {
+		return false
+	}
+	if value, err := strconv.ParseFloat(minDuration, 64); err == nil && media.Duration < value {
+		return false
+	}
+	if value, err := strconv.ParseFloat(maxDuration, 64); err == nil && media.Duration > value {
+		return false
+	}
+	if codec != "" {
+		negate := strings.HasPrefix(codec, "!")
+		matched := strings.EqualFold(media.VideoCodec, strings.TrimPrefix(codec, "!"))
+		if matched == negate {
+			return false
+		}
+	}
+	return true
+}
+
+// 视频来源信息（下载时由yt-dlp的info json整理得到）
+type SourceMetadata struct {
+	TaskID       string          `json:"taskID"`
+	RequestURL   string          `json:"requestURL"` // 提交下载时的网址
+	SourceURL    string          `json:"sourceURL"`  // 视频页面网址
+	Extractor    string          `json:"extractor"`
+	ID           string          `json:"id"`
+	Title        string          `json:"title"`
+	Uploader     string          `json:"uploader"`
+	UploadDate   string          `json:"uploadDate"` // YYYYMMDD
+	Description  string          `json:"description"`
+	Tags         []string        `json:"tags"`
+	Duration     float64         `json:"duration"`
+	Args         []string        `json:"args"` // 下载时使用的yt-dlp命令参数
+	DownloadedAt time.Time       `json:"downloadedAt"`
+	Info         json.RawMessage `json:"info,omitempty"` // 完整的yt-dlp info json
+}
+
+// 视频库根目录下保存来源信息的目录（隐藏目录，扫描时忽略）
+const metadataDirName = ".metadata"
+
+// 下载过程中的格式文件后缀，例如 "xxx.f137.mp4"
+var formatFileSuffixRe = regexp.MustCompile(`\.f(\d+|hls|dash|http)[\w-]*$`)
+
+// 获取视频文件对应的来源信息路径（目录结构与视频库相同）
+func metadataPathFor(root, rel string) string {
+	return filepath.Join(root, metadataDirName, filepath.FromSlash(rel)+".json")
+}
+
+// 从yt-dlp输出的文件名得到不含扩展名和格式后缀的基础名称，相同视频的格式文件、合并文件和info json共用该名称
+func downloadStem(filename string) string {
+	stem := strings.TrimSuffix(filename, filepath.Ext(filename))
+	return formatFileSuffixRe.ReplaceAllString(stem, "")
+}
+
+// 查找与基础名称对应的最终媒体文件，优先查找视频，其次是音频（仅下载音频时）
+func findMediaForStem(dir, stem string) string {
+	extensions := append(append([]string{}, videoExtensions...), audioExtensions...)
+	for _, ext := range extensions {
+		if _, err := os.Stat(filepath.Join(dir, stem+ext)); err == nil {
+			return stem + ext
+		}
+	}
+	return ""
+}
+
+// yt-dlp写出的视频封面可能的扩展名（--convert-thumbnails失败时保留原格式）
+var sidecarThumbnailExtensions = []string{".jpg", ".jpeg", ".webp", ".png"}
+
+// 在多个目录中查找与基础名称对应的附属文件（info json、封面等），返回第一个存在的路径
+func findSidecarFile(dirs []string, stem string, suffixes ...string) string {
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		for _, suffix := range suffixes {
+			candidate := filepath.Join(dir, stem+suffix)
+			if _, err := os.Stat(candidate); err == nil {
+				return candidate
+			}
+		}
+	}
+	return ""
+}
+
+// 下载完成后把yt-dlp写出的视频封面转换为视频库的缩略图，返回已保存缩略图的视频相对路径
+func storeJobThumbnails(job Job, files []string) []string {
+	tempDir := argsTempDir(job.Args)
+	seen := make(map[string]bool)
+	var stored []string
+
+	for _, file := range files {
+		rel := libraryRelativePath(file, job.Dir, tempDir)
+		if filepath.IsAbs(rel) {
+			continue
+		}
+		stem := downloadStem(rel)
+		if seen[stem] {
+			continue
+		}
+		seen[stem] = true
+
+		imagePath := findSidecarFile([]string{job.Dir, tempDir}, stem, sidecarThumbnailExtensions...)
+		videoRel := findMediaForStem(job.Dir, stem)
+		if imagePath == "" || videoRel == "" {
+			continue
+		}
+		videoRel = filepath.ToSlash(videoRel)
+		thumbnailPath := thumbnailPathFor(job.Dir, videoRel)
+		if err := convertThumbnailImage(imagePath, thumbnailPath); err != nil {
+			log.Printf("保存视频封面失败 %s: %v", imagePath, err)
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(job.Dir, filepath.FromSlash(videoRel))); err == nil {
+			recordCacheStamp(thumbnailPath, info)
+		}
+		// 只删除程序自动添加--write-thumbnail写出的封面
+		if !job.KeepCover {
+			os.Remove(imagePath)
+		}
+		stored = append(stored, videoRel)
+	}
+	return stored
+}
+
+// 下载完成后把yt-dlp写出的info json整理到来源信息目录，返回已保存的视频相对路径
+func storeJobMetadata(job Job, files []string) []string {
+	tempDir := argsTempDir(job.Args)
+	seen := make(map[string]bool)
+	var stored []string
+
+	for _, file := range files {
+		rel := libraryRelativePath(file, job.Dir, tempDir)
+		if filepath.IsAbs(rel) {
+			continue
+		}
+		stem := downloadStem(rel)
+		if seen[stem] {
+			continue
+		}
+		seen[stem] = true
+
+		// info json在下载完成后与视频一起移动到视频库，使用临时目录时也可能留在临时目录中
+		infoPath := findSidecarFile([]string{job.Dir, tempDir}, stem, ".info.json")
+		videoRel := findMediaForStem(job.Dir, stem)
+		if infoPath == "" || videoRel == "" {
+			continue
+		}
+
+		data, err := os.ReadFile(infoPath)
+		if err != nil {
+			continue
+		}
+		var info ytdlpInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			log.Printf("解析info json失败 %s: %v", infoPath, err)
+			continue
+		}
+		metadata := SourceMetadata{
+			TaskID:       job.ID,
+			RequestURL:   job.URL,
+			SourceURL:    info.WebpageURL,
+			Extractor:    info.Extractor,
+			ID:           info.ID,
+			Title:        info.Title,
+			Uploader:     info.Uploader,
+			UploadDate:   info.UploadDate,
+			Description:  info.Description,
+			Tags:         info.Tags,
+			Duration:     info.Duration,
+			Args:         job.Args,
+			DownloadedAt: time.Now(),
+			Info:         json.RawMessage(data),
+		}
+		if err := writeSourceMetadata(job.Dir, filepath.ToSlash(videoRel), metadata); err != nil {
+			log.Printf("保存来源信息失败 %s: %v", videoRel, err)
+			continue
+		}
+		os.Remove(infoPath)
+		stored = append(stored, filepath.ToSlash(videoRel))
+	}
+	return stored
+}
+
+// 保存视频的来源信息
+func writeSourceMetadata(root, rel string, metadata SourceMetadata) error {
+	metadataPath := metadataPathFor(root, rel)
+	if err := os.MkdirAll(filepath.Dir(metadataPath), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	tmpPath := metadataPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	defer invalidateLibraryIDIndex()
+	return os.Rename(tmpPath, metadataPath)
+}
+
+// 读取视频的来源信息
+func readSourceMetadata(root, rel string) (*SourceMetadata, error) {
+	data, err := os.ReadFile(metadataPathFor(root, rel))
+	if err != nil {
+		return nil, err
+	}
+	var metadata SourceMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// 重命名视频时同步移动来源信息
+func moveSourceMetadata(root, oldRel, newRel string) {
+	oldPath := metadataPathFor(root, oldRel)
+	if _, err := os.Stat(oldPath); err != nil {
+		return
+	}
+	newPath := metadataPathFor(root, newRel)
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err == nil {
+		os.Rename(oldPath, newPath)
+	}
+}
+
+// 文件改名后，把旧文件名的媒体索引、来源元数据、观看记录和预览图移到新文件名下
+func moveLibraryEntries(root, oldRel, newRel string) {
+	renameMediaIndexEntry(filepath.Join(root, filepath.FromSlash(oldRel)), filepath.Join(root, filepath.FromSlash(newRel)))
+	moveSourceMetadata(root, oldRel, newRel)
+	renameWatchHistory(oldRel, newRel)
+	removeThumbnailVariants(root, oldRel)
+
+	// 同时重命名对应的预览图，缓存记录一并迁移，避免重新生成
+	oldThumbnailPath := thumbnailPathFor(root, oldRel)
+	newThumbnailPath := thumbnailPathFor(root, newRel)
+	if _, err := os.Stat(oldThumbnailPath); err == nil {
+		os.MkdirAll(filepath.Dir(newThumbnailPath), 0755)
+		if os.Rename(oldThumbnailPath, newThumbnailPath) == nil {
+			thumbnailMu.Lock()
+			if stamp, ok := cacheStamps[oldThumbnailPath]; ok {
+				delete(cacheStamps, oldThumbnailPath)
+				cacheStamps[newThumbnailPath] = stamp
+				saveThumbnailIndexLocked()
+			}
+			thumbnailMu.Unlock()
+		}
+	}
+}
+
+// 重复视频的处理方式
+const (
+	DuplicateSkip      = "skip"      // 跳过视频库中已有的视频
+	DuplicateOverwrite = "overwrite" // 重新下载，并把视频库中相同视频的其他文件移到回收站
+	DuplicateKeep      = "keep"      // 不检查重复，保留两份
+)
+
+// yt-dlp跳过下载记录中已有视频时的输出，例如 "[download] 视频标题 has already been recorded in the archive"
+var archiveSkipRe = regexp.MustCompile(`^\[download\] (.+) has already been recorded in the archive`)
+
+// 视频的唯一标识，与yt-dlp下载记录文件的格式相同："<提取器名称小写> <视频ID>"
+func archiveKey(extractor, id string) string {
+	if extractor == "" || id == "" {
+		return ""
+	}
+	return strings.ToLower(extractor) + " " + id
+}
+
+var (
+	youtubeIDRe  = regexp.MustCompile(`^/(?:shorts|embed|live|v)/([0-9A-Za-z_-]{11})`)
+	tiktokIDRe   = regexp.MustCompile(`/video/(\d+)`)
+	bilibiliIDRe = regexp.MustCompile(`/video/(BV[0-9A-Za-z]{10})`)
+)
+
+// 从常见平台的视频网址中直接解析出视频标识，无法识别时返回空字符串
+func urlArchiveKey(videoURL string) string {
+	parsedURL, err := url.Parse(videoURL)
+	if err != nil {
+		return ""
+	}
+	host := strings.TrimPrefix(strings.ToLower(parsedURL.Hostname()), "www.")
+	hostIs := func(domain string) bool {
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	}
+	switch {
+	case hostIs("youtu.be"):
+		id := strings.Trim(parsedURL.Path, "/")
+		if len(id) == 11 {
+			return archiveKey("youtube", id)
+		}
+	case hostIs("youtube.com"):
+		if id := parsedURL.Query().Get("v"); len(id) == 11 {
+			return archiveKey("youtube", id)
+		}
+		if m := youtubeIDRe.FindStringSubmatch(parsedURL.Path); m != nil {
+			return archiveKey("youtube", m[1])
+		}
+	case hostIs("tiktok.com"):
+		if m := tiktokIDRe.FindStringSubmatch(parsedURL.Path); m != nil {
+			return archiveKey("tiktok", m[1])
+		}
+	case hostIs("bilibili.com"):
+		// 多P视频的标识带有分P后缀，交给yt-dlp的下载记录判断
+		if m := bilibiliIDRe.FindStringSubmatch(parsedURL.Path); m != nil && parsedURL.Query().Get("p") == "" {
+			return archiveKey("bilibili", m[1])
+		}
+	}
+	return ""
+}
+
+// 视频库的标识索引（根据下载时保存的来源信息）
+type libraryIDIndex struct {
+	ByKey   map[string][]string // 视频标识 -> 视频相对路径
+	ByURL   map[string]string   // 视频页面网址 -> 视频相对路径
+	ByTitle map[string][]string // 标题 -> 视频相对路径
+}
+
+// 根据来源信息建立视频库的标识索引
+func buildLibraryIDIndex(root string) libraryIDIndex {
+	index := libraryIDIndex{
+		ByKey:   make(map[string][]string),
+		ByURL:   make(map[string]string),
+		ByTitle: make(map[string][]string),
+	}
+	walkLibrary(root, "", func(rel string, entry fs.DirEntry) error {
+		if entry.IsDir() || mediaKindOf(entry.Name()) == "" {
+			return nil
+		}
+		summary := lookupSourceSummary(root, rel)
+		if summary == nil {
+			return nil
+		}
+		if key := archiveKey(summary.Extractor, summary.ID); key != "" {
+			index.ByKey[key] = append(index.ByKey[key], rel)
+		}
+		if summary.SourceURL != "" {
+			index.ByURL[summary.SourceURL] = rel
+		}
+		if summary.Title != "" {
+			index.ByTitle[summary.Title] = append(index.ByTitle[summary.Title], rel)
+		}
+		return nil
+	})
+	return index
+}
+
+var (
+	libraryIDs     libraryIDIndex // 缓存的视频库标识索引，视频库或来源信息变化后重建
+	libraryIDsRoot string
+	libraryIDsGen  int // 每次失效时递增，避免重建期间的变化被旧索引覆盖
+	libraryIDsMu   sync.Mutex
+)
+
+// 获取视频库的标识索引，只在视频库变化后重新遍历
+func cachedLibraryIDIndex(root string) libraryIDIndex {
+	libraryIDsMu.Lock()
+	if libraryIDs.ByKey != nil && libraryIDsRoot == root {
+		index := libraryIDs
+		libraryIDsMu.Unlock()
+		return index
+	}
+	gen := libraryIDsGen
+	libraryIDsMu.Unlock()
+
+	index := buildLibraryIDIndex(root)
+	libraryIDsMu.Lock()
+	if gen == libraryIDsGen {
+		libraryIDs = index
+		libraryIDsRoot = root
+	}
+	libraryIDsMu.Unlock()
+	return index
+}
+
+// 视频库文件或来源信息变化后使缓存的标识索引失效
+func invalidateLibraryIDIndex() {
+	libraryIDsMu.Lock()
+	libraryIDs = libraryIDIndex{}
+	libraryIDsGen++
+	libraryIDsMu.Unlock()
+}
+
+// 按任务的重复处理方式准备本次运行的命令参数：skip时生成包含视频库中所有视频标识的下载记录文件，
+// yt-dlp会跳过其中已有的视频；返回参数、需要在运行结束后删除的下载记录文件以及标识索引
+func prepareDuplicateArgs(job *Job, dir string, firstAttempt bool) ([]string, string, libraryIDIndex) {
+	args := job.Args
+	switch job.Duplicate {
+	case DuplicateOverwrite:
+		// 只在第一次运行时强制覆盖，重试和暂停后继续时保留已下载的部分以便断点续传
+		if firstAttempt && !hasArg(args, "--force-overwrites") {
+			args = insertArgsBeforeURL(args, "--force-overwrites")
+		}
+	case DuplicateSkip:
+		// 用户在参数中指定了自己的下载记录文件时不再添加
+		if hasArg(args, "--download-archive") {
+			break
+		}
+		index := cachedLibraryIDIndex(dir)
+		archive, err := os.CreateTemp("", "videodown-archive-*.txt")
+		if err != nil {
+			log.Printf("创建下载记录文件失败: %v", err)
+			break
+		}
+		for key := range index.ByKey {
+			fmt.Fprintln(archive, key)
+		}
+		archive.Close()
+		args = insertArgsBeforeURL(args, "--download-archive", archive.Name())
+		return args, archive.Name(), index
+	}
+	return args, "", libraryIDIndex{}
+}
+
+// 下载完成后处理overwrite：把视频库中与新下载视频标识相同的其他文件移到回收站
+func replaceDuplicates(job Job, stored []string) []string {
+	if job.Duplicate != DuplicateOverwrite || len(stored) == 0 {
+		return nil
+	}
+	index := cachedLibraryIDIndex(job.Dir)
+	keep := make(map[string]bool)
+	for _, rel := range stored {
+		keep[rel] = true
+	}
+
+	var replaced []string
+	for _, rel := range stored {
+		summary := lookupSourceSummary(job.Dir, rel)
+		if summary == nil {
+			continue
+		}
+		for _, other := range index.ByKey[archiveKey(summary.Extractor, summary.ID)] {
+			if keep[other] {
+				continue
+			}
+			if _, err := moveToTrash(job.Dir, other); err != nil {
+				log.Printf("移除重复视频失败 %s: %v", other, err)
+				continue
+			}
+			keep[other] = true
+			replaced = append(replaced, other)
+			publishLibraryEvent(LibraryEvent{Action: "removed", Name: other})
+		}
+	}
+	return replaced
+}
+
+// 一组重复的文件
+type DuplicateGroup struct {
+	Method string          `json:"method"` // "id"（相同的提取器和视频ID）或 "hash"（文件内容相同）
+	Key    string          `json:"key"`
+	Files  []DuplicateFile `json:"files"`
+}
+
+// 重复组中的文件
+type DuplicateFile struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	Title     string    `json:"title,omitempty"`
+}
+
+// 文件内容哈希缓存（按路径、大小和修改时间）
+type fileHashEntry struct {
+	Size    int64
+	ModTime time.Time
+	Hash    string
+}
+
+var (
+	fileHashes   = make(map[string]fileHashEntry) // 绝对路径 -> 内容哈希
+	fileHashesMu sync.Mutex
+)
+
+// 计算文件内容的SHA-256哈希，文件未变化时使用缓存
+func fileContentHash(filePath string, info fs.FileInfo) (string, error) {
+	fileHashesMu.Lock()
+	cached, ok := fileHashes[filePath]
+	fileHashesMu.Unlock()
+	if ok && cached.Size == info.Size() && cached.ModTime.Equal(info.ModTime()) {
+		return cached.Hash, nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	fileHashesMu.Lock()
+	fileHashes[filePath] = fileHashEntry{Size: info.Size(), ModTime: info.ModTime(), Hash: sum}
+	fileHashesMu.Unlock()
+	return sum, nil
+}
+
+// 查找视频库中的重复文件；method为"id"、"hash"或空（两种都查找）
+func findDuplicateGroups(root, method string) []DuplicateGroup {
+	type candidate struct {
+		file    DuplicateFile
+		info    fs.FileInfo
+		summary *sourceSummary
+	}
+	var candidates []candidate
+	walkLibrary(root, "", func(rel string, entry fs.DirEntry) error {
+		kind := mediaKindOf(entry.Name())
+		if entry.IsDir() || (kind != MediaKindVideo && kind != MediaKindAudio) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		c := candidate{
+			file:    DuplicateFile{Name: rel, Size: info.Size(), CreatedAt: info.ModTime()},
+			info:    info,
+			summary: lookupSourceSummary(root, rel),
+		}
+		if c.summary != nil {
+			c.file.Title = c.summary.Title
+		}
+		candidates = append(candidates, c)
+		return nil
+	})
+
+	groups := make([]DuplicateGroup, 0)
+
+	// 相同的提取器和视频ID（来自下载时保存的来源信息）
+	if method == "" || method == "id" {
+		byKey := make(map[string][]DuplicateFile)
+		for _, c := range candidates {
+			if c.summary == nil {
+				continue
+			}
+			if key := archiveKey(c.summary.Extractor, c.summary.ID); key != "" {
+				byKey[key] = append(byKey[key], c.file)
+			}
+		}
+		for key, files := range byKey {
+			if len(files) > 1 {
+				groups = append(groups, DuplicateGroup{Method: "id", Key: key, Files: files})
+			}
+		}
+	}
+
+	// 文件内容相同：只对大小相同的文件计算哈希
+	if method == "" || method == "hash" {
+		bySize := make(map[int64][]candidate)
+		for _, c := range candidates {
+			if c.info.Size() > 0 {
+				bySize[c.info.Size()] = append(bySize[c.info.Size()], c)
+			}
+		}
+		for _, sameSize := range bySize {
+			if len(sameSize) < 2 {
+				continue
+			}
+			byHash := make(map[string][]DuplicateFile)
+			for _, c := range sameSize {
+				hash, err := fileContentHash(filepath.Join(root, filepath.FromSlash(c.file.Name)), c.info)
+				if err != nil {
+					continue
+				}
+				byHash[hash] = append(byHash[hash], c.file)
+			}
+			for hash, files := range byHash {
+				if len(files) > 1 {
+					groups = append(groups, DuplicateGroup{Method: "hash", Key: hash, Files: files})
+				}
+			}
+		}
+	}
+
+	// 按方式和标识排序，组内按名称排序
+	for _, group := range groups {
+		sort.Slice(group.Files, func(i, j int) bool { return group.Files[i].Name < group.Files[j].Name })
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Method != groups[j].Method {
+			return groups[i].Method < groups[j].Method
+		}
+		return groups[i].Key < groups[j].Key
+	})
+	return groups
+}
+
+// 处理重复文件查询请求：GET /api/duplicates?method=id|hash
+func handleDuplicates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	method := r.URL.Query().Get("method")
+	if method != "" && method != "id" && method != "hash" {
+		http.Error(w, "Invalid method", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"groups": findDuplicateGroups(getLibraryRoot(), method),
+	})
+}
+
+// 处理视频详情请求：GET /api/videos/{name}/info 返回来源信息
+func handleVideoDetail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	escapedPath := strings.TrimPrefix(r.URL.EscapedPath(), "/api/videos/")
+	if !strings.HasSuffix(escapedPath, "/info") {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	name, err := url.PathUnescape(strings.TrimSuffix(escapedPath, "/info"))
+	if err != nil || name == "" {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	root := getLibraryRoot()
+	filePath, rel, err := resolveLibraryPath(root, name)
+	if err != nil {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	metadata, err := readSourceMetadata(root, rel)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Source metadata not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read source metadata", http.StatusInternalServerError)
+		}
+		return
+	}
+	// 完整的info json较大，只在请求时返回
+	if r.URL.Query().Get("full") != "1" {
+		metadata.Info = nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(metadata)
+}
+
+// 处理视频流API请求
+func handleVideoStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 从URL路径中提取相对视频库根目录的文件路径
+	decodedFilename, err := libraryPathFromURL(r, "/api/video/")
+	if err != nil {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	if decodedFilename == "" {
+		http.Error(w, "Filename not provided", http.StatusBadRequest)
+		return
+	}
+
+	// 获取视频库根目录
+	root := getLibraryRoot()
+
+	// 构建完整文件路径，防止路径遍历攻击
+	filePath, rel, err := resolveLibraryPath(root, decodedFilename)
+	if err != nil {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	// 检查文件是否为支持的视频格式
+	lowerFilename := strings.ToLower(decodedFilename)
+	if !isVideoFile(decodedFilename) {
+		http.Error(w, "Invalid file type", http.StatusBadRequest)
+		return
+	}
+
+	// 检查文件是否存在
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// 根据文件扩展名设置正确的MIME类型
+	var contentType string
+	switch {
+	case strings.HasSuffix(lowerFilename, ".mp4"):
+		contentType = "video/mp4"
+	case strings.HasSuffix(lowerFilename, ".webm"):
+		contentType = "video/webm"
+	case strings.HasSuffix(lowerFilename, ".mkv"):
+		contentType = "video/x-matroska"
+	case strings.HasSuffix(lowerFilename, ".flv"):
+		contentType = "video/x-flv"
+	case strings.HasSuffix(lowerFilename, ".avi"):
+		contentType = "video/x-msvideo"
+	case strings.HasSuffix(lowerFilename, ".mov"):
+		contentType = "video/quicktime"
+	default:
+		contentType = "video/mp4" // 默认MIME类型
+	}
+
+	// 记录播放时间，存储清理时优先清理没有看过的视频
+	recordWatched(rel)
+
+	// 设置响应头
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// 提供文件服务
+	http.ServeFile(w, r, filePath)
+}
+
+// 处理需要转码的视频流
+func handleVideoTranscode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 从URL路径中提取相对视频库根目录的文件路径
+	decodedFilename, err := libraryPathFromURL(r, "/api/video-transcode/")
+	if err != nil {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	if decodedFilename == "" {
+		http.Error(w, "Filename not provided", http.StatusBadRequest)
+		return
+	}
+
+	// 获取视频库根目录
+	root := getLibraryRoot()
+
+	// 构建完整文件路径，防止路径遍历攻击
+	filePath, _, err := resolveLibraryPath(root, decodedFilename)
+	if err != nil {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	// 检查文件是否存在
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// 检查ffmpeg是否存在
+	ffmpegPath := getExecutablePath("ffmpeg")
+	if _, err := os.Stat(ffmpegPath); os.IsNotExist(err) {
+		http.Error(w, "FFmpeg not found", http.StatusInternalServerError)
+		return
+	}
+
 	// 设置响应头为MP4流
 	w.Header().Set("Content-Type", "video/mp4")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	// 构建ffmpeg命令进行实时转码
+	cmd := exec.Command(ffmpegPath,
+		"-i", filePath,
+		"-c:v", "libx264",
+		"-c:a", "aac",
+		"-preset", "ultrafast",
+		"-tune", "zerolatency",
+		"-movflags", "frag_keyframe+empty_moov",
+		"-f", "mp4",
+		"pipe:1")
+
+	// 设置命令的标准输出为HTTP响应
+	cmd.Stdout = w
+	cmd.Stderr = nil // 忽略错误输出
+
+	// 执行转码命令
+	if err := cmd.Run(); err != nil {
+		log.Printf("FFmpeg转码错误: %v", err)
+		// 如果转码失败，尝试直接提供原文件
+		http.ServeFile(w, r, filePath)
+	}
+}
+
+// 向所有WebSocket客户端广播消息
+// 向指定任务ID的客户端发送消息
+func sendMessageToTask(taskID, message, msgType string) {
+	// 记录到任务日志，供任务查询接口使用
+	if message != "COMMAND_FINISHED" {
+		appendJobLog(taskID, message)
+	}
+
+	sentCount := writeToTaskClients(WSMessage{
+		TaskID:  taskID,
+		Message: message,
+		Type:    msgType,
+	})
+
+	log.Printf("向任务 %s 发送消息: %s (发送给 %d 个客户端)", taskID, message, sentCount)
+}
+
+// 向指定任务ID的客户端发送结构化进度消息
+func sendProgressToTask(taskID string, progress ProgressInfo) {
+	writeToTaskClients(WSMessage{
+		TaskID:   taskID,
+		Type:     "progress",
+		Progress: &progress,
+	})
+}
+
+// 向订阅了该任务的客户端发送任务状态变化消息
+func sendTaskStatus(taskID, status string) {
+	writeToTaskClients(WSMessage{
+		TaskID:  taskID,
+		Message: status,
+		Type:    "status",
+	})
+}
+
+// 将消息写入订阅了该任务的所有客户端，返回发送成功的数量
+func writeToTaskClients(wsMsg WSMessage) int {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	// 先写入任务消息缓存并分配序号，这样尚未注册的客户端之后也能收到
+	backlog, exists := taskBacklogs[wsMsg.TaskID]
+	if !exists {
+		backlog = &messageBacklog{}
+		taskBacklogs[wsMsg.TaskID] = backlog
+	}
+	wsMsg = backlog.add(wsMsg)
+
+	sentCount := 0
+	for conn, clientInfo := range clients {
+		if clientInfo.wantsTask(wsMsg.TaskID) {
+			err := conn.WriteJSON(wsMsg)
+			if err != nil {
+				log.Printf("发送消息错误: %v", err)
+				conn.Close()
+				delete(clients, conn)
+			} else {
+				sentCount++
+			}
+		}
+	}
+
+	return sentCount
+}
+
+// 任务消息缓存（固定容量，超出时丢弃最早的消息）
+type messageBacklog struct {
+	nextSeq  int64
+	messages []WSMessage
+}
+
+// 为消息分配序号并加入缓存，下载进度消息只保留最新的一条，避免挤掉日志
+func (b *messageBacklog) add(wsMsg WSMessage) WSMessage {
+	b.nextSeq++
+	wsMsg.Seq = b.nextSeq
+	if isProgressMessage(wsMsg) {
+		for i := len(b.messages) - 1; i >= 0; i-- {
+			if b.messages[i].Type == wsMsg.Type && isProgressMessage(b.messages[i]) {
+				b.messages = append(b.messages[:i], b.messages[i+1:]...)
+				break
+			}
+		}
+	}
+	b.messages = append(b.messages, wsMsg)
+	if len(b.messages) > maxTaskBacklog {
+		b.messages = append([]WSMessage(nil), b.messages[len(b.messages)-maxTaskBacklog:]...)
+	}
+	return wsMsg
+}
+
+// 检查是否为下载进度消息（结构化进度或yt-dlp输出的进度行）
+func isProgressMessage(wsMsg WSMessage) bool {
+	if wsMsg.Type == "progress" {
+		return true
+	}
+	if wsMsg.Type != "log" {
+		return false
+	}
+	_, ok := parseProgress(wsMsg.Message)
+	return ok
+}
+
+// 向客户端回放指定序号之后的缓存消息（调用方需持有clientsMu）
+func replayBacklogLocked(conn *websocket.Conn, taskID string, afterSeq int64) int {
+	backlog, exists := taskBacklogs[taskID]
+	if !exists {
+		return 0
+	}
+
+	replayed := 0
+	for _, wsMsg := range backlog.messages {
+		if wsMsg.Seq <= afterSeq {
+			continue
+		}
+		if err := conn.WriteJSON(wsMsg); err != nil {
+			log.Printf("回放消息错误: %v", err)
+			break
+		}
+		replayed++
+	}
+	return replayed
+}
+
+// 删除任务的消息缓存
+func dropTaskBacklog(taskID string) {
+	clientsMu.Lock()
+	delete(taskBacklogs, taskID)
+	clientsMu.Unlock()
+}
+
+// 向订阅了指定全局主题的客户端发送消息
+func publishTopic(topic, msgType string, data interface{}) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	wsMsg := WSMessage{
+		Type:  msgType,
+		Topic: topic,
+		Data:  data,
+	}
+
+	for conn, clientInfo := range clients {
+		if !clientInfo.Topics[topic] {
+			continue
+		}
+		if err := conn.WriteJSON(wsMsg); err != nil {
+			log.Printf("发送消息错误: %v", err)
+			conn.Close()
+			delete(clients, conn)
+		}
+	}
+}
+
+// 兼容性函数：广播消息给所有客户端（用于系统消息）
+func broadcastMessage(message string) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	wsMsg := WSMessage{
+		TaskID:  "",
+		Message: message,
+		Type:    "system",
+	}
+
+	log.Printf("系统广播消息: %s (客户端数量: %d)", message, len(clients))
+
+	for conn := range clients {
+		err := conn.WriteJSON(wsMsg)
+		if err != nil {
+			log.Printf("发送消息错误: %v", err)
+			conn.Close()
+			delete(clients, conn)
+		}
+	}
+}
+
+// 处理运行yt-dlp的请求
+func handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只允许POST请求", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 解析请求参数
+	var req RunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "无效的JSON参数", http.StatusBadRequest)
+		return
+	}
+
+	// 验证参数
+	if req.URL == "" || req.TaskID == "" {
+		http.Error(w, "URL和任务ID参数不能为空", http.StatusBadRequest)
+		return
+	}
+
+	// 查找平台规则，未指定平台或没有同名规则（旧版或自定义的平台名称）时根据网址自动识别，
+	// 仍然没有适用的规则时与之前一样直接使用yt-dlp的默认参数
+	ruleList := getRules()
+	var rule *PlatformRule
+	if req.Platform != "" {
+		rule = findRule(ruleList, req.Platform)
+	}
+	if rule == nil {
+		rule = detectRule(ruleList, req.URL)
+	}
+	if rule == nil {
+		rule = &PlatformRule{Name: req.Platform}
+	}
+	req.Platform = rule.Name
+
+	// 设置默认视频格式
+	if req.VideoFormat == "" {
+		req.VideoFormat = "mp4"
+	}
+
+	// 根据是否启用高级选项构建命令参数
+	var args []string
+	if req.Config.EnableAdvanced {
+		args = buildAdvancedCommandArgs(req.Config, req.URL, req.VideoFormat)
+	} else {
+		args = buildCommandArgs(rule, req.URL, req.VideoFormat)
+	}
+
+	// 添加规则中的其他参数和输出模板（输出模板不能写到视频库之外）
+	if err := validateOutputTemplate(rule.Output); err != nil {
+		http.Error(w, fmt.Sprintf("规则 %s 的输出模板无效: %v", rule.Name, err), http.StatusBadRequest)
+		return
+	}
+	extraArgs := append([]string{}, rule.ExtraArgs...)
+	if rule.Output != "" {
+		extraArgs = append(extraArgs, "-o", rule.Output)
+	}
+	args = insertArgsBeforeURL(args, extraArgs...)
+
+	// 使用服务端设置的输出模板（规则中已指定时除外）和临时目录
+	currentSettings := getSettings()
+	if currentSettings.OutputTemplate != "" && !hasArg(args, "-o") {
+		args = insertArgsBeforeURL(args, "-o", currentSettings.OutputTemplate)
+	}
+	if tempDir := getTempDir(); tempDir != "" {
+		args = insertArgsBeforeURL(args, "-P", "temp:"+tempDir)
+	}
+
+	// 写出info json，下载完成后整理为来源信息
+	if !hasArg(args, "--write-info-json") {
+		args = insertArgsBeforeURL(args, "--write-info-json")
+	}
+	// 写出平台提供的视频封面，下载完成后作为缩略图（用户自己要求写出封面时保留封面文件）
+	keepCover := hasArg(args, "--write-thumbnail")
+	if !keepCover {
+		args = insertArgsBeforeURL(args, "--write-thumbnail")
+		if !hasArg(args, "--convert-thumbnails") {
+			args = insertArgsBeforeURL(args, "--convert-thumbnails", "jpg")
+		}
+	}
+
+	applyRuleCookies(&req.Config, rule)
+
+	// 添加Cookie参数
+	cookieArgs, err := buildCookieArgs(req.Config, req.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	args = insertArgsBeforeURL(args, cookieArgs...)
+
+	// 只下载预览时选中的播放列表条目
+	if req.PlaylistItems != "" {
+		if !playlistItemsRe.MatchString(req.PlaylistItems) {
+			http.Error(w, "无效的播放列表条目参数", http.StatusBadRequest)
+			return
+		}
+		args = insertArgsBeforeURL(args, "--playlist-items", req.PlaylistItems)
+	}
+
+	// 应用明确的格式ID和编码偏好
+	if req.Format != nil {
+		if args, err = applyFormatSelection(args, *req.Format); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// 重复视频的处理方式，skip时直接拒绝视频库中已有的同一视频：
+	// 能从网址解析出视频标识时按提取器和视频ID查找，否则比较来源网址
+	duplicate := req.Duplicate
+	if duplicate == "" {
+		duplicate = currentSettings.DuplicatePolicy
+	}
+	switch duplicate {
+	case DuplicateSkip:
+		index := cachedLibraryIDIndex(getLibraryRoot())
+		existing := index.ByURL[req.URL]
+		if key := urlArchiveKey(req.URL); key != "" {
+			existing = strings.Join(index.ByKey[key], ", ")
+		}
+		if existing != "" {
+			http.Error(w, fmt.Sprintf("视频库中已有该视频: %s", existing), http.StatusConflict)
+			return
+		}
+	case DuplicateOverwrite, DuplicateKeep:
+	default:
+		http.Error(w, "无效的重复视频处理方式", http.StatusBadRequest)
+		return
+	}
+
+	// 检查视频库容量和磁盘剩余空间
+	if err := checkStorageQuota(); err != nil {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+
+	// 使用请求中的重试策略，未提供的部分采用服务端默认值
+	retry := getSettings().Retry
+	if req.Retry != nil {
+		retry = normalizeRetryPolicy(*req.Retry, retry)
+	}
+
+	job := &Job{
+		ID:          req.TaskID,
+		Platform:    req.Platform,
+		URL:         req.URL,
+		Config:      req.Config,
+		VideoFormat: req.VideoFormat,
+		Format:      req.Format,
+		Dir:         getLibraryRoot(),
+		Args:        args,
+		Duplicate:   duplicate,
+		KeepCover:   keepCover,
+		Retry:       retry,
+		Status:      JobQueued,
+		CreatedAt:   time.Now(),
+	}
+
+	// 检查任务ID是否已存在（已结束的同名任务会被新任务替换）
+	jobsMu.Lock()
+	if existing := findJobLocked(req.TaskID); existing != nil {
+		if !isJobTerminal(existing.Status) {
+			jobsMu.Unlock()
+			http.Error(w, "任务ID已存在，请使用不同的任务ID", http.StatusConflict)
+			return
+		}
+		removeJobLocked(req.TaskID)
+	}
+	jobs = append(jobs, job)
+	position := countJobsLocked(JobQueued)
+	saveQueueLocked()
+	jobsMu.Unlock()
+
+	sendTaskStatus(req.TaskID, JobQueued)
+	sendMessageToTask(req.TaskID, fmt.Sprintf("[%s] 任务已加入下载队列（排队位置: %d）", time.Now().Format("2006-01-02 15:04:05"), position), "log")
+
+	// 尝试立即调度
+	scheduleJobs()
+
+	// 返回成功响应
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("任务已加入队列"))
+}
+
+// 判断任务是否已经结束
+func isJobTerminal(status string) bool {
+	return status == JobFinished || status == JobFailed || status == JobStopped
+}
+
+// 根据任务ID查找任务（调用方需持有jobsMu）
+func findJobLocked(id string) *Job {
+	for _, job := range jobs {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// 从队列中移除任务（调用方需持有jobsMu）
+func removeJobLocked(id string) {
+	for i, job := range jobs {
+		if job.ID == id {
+			jobs = append(jobs[:i], jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+// 统计指定状态的任务数量（调用方需持有jobsMu）
+func countJobsLocked(status string) int {
+	count := 0
+	for _, job := range jobs {
+		if job.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// 保存下载队列到文件（调用方需持有jobsMu）
+func saveQueueLocked() {
+	// 只保留最近的已结束任务，防止队列文件无限增长
+	finished := 0
+	for i := len(jobs) - 1; i >= 0; i-- {
+		if isJobTerminal(jobs[i].Status) {
+			finished++
+			if finished > maxFinishedJobs {
+				dropTaskBacklog(jobs[i].ID)
+				jobs = append(jobs[:i], jobs[i+1:]...)
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		log.Printf("序列化下载队列失败: %v", err)
+		return
+	}
+
+	// 先写入临时文件再替换，避免写入中断导致队列文件损坏
+	tempFile := queueFile + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0644); err != nil {
+		log.Printf("保存下载队列失败: %v", err)
+		return
+	}
+	if err := os.Rename(tempFile, queueFile); err != nil {
+		log.Printf("保存下载队列失败: %v", err)
+	}
+}
+
+// 启动时从文件加载下载队列，被中断的任务重新排队
+func loadQueue() {
+	data, err := os.ReadFile(queueFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取下载队列失败: %v", err)
+		}
+		return
+	}
+
+	var loaded []*Job
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		log.Printf("解析下载队列失败: %v", err)
+		return
+	}
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	pending := 0
+	for _, job := range loaded {
+		if job == nil || job.ID == "" {
+			continue
+		}
+		if job.Status == JobRunning {
+			// 上次退出时仍在下载的任务，重新排队以便从临时文件继续下载
+			job.Status = JobQueued
+			job.StartedAt = nil
+		}
+		if job.Status == JobQueued {
+			pending++
+		}
+		jobs = append(jobs, job)
+	}
+
+	log.Printf("已加载下载队列: 共 %d 个任务，%d 个待下载", len(jobs), pending)
+}
+
+// 调度下载队列，在并发数量允许的情况下启动排队中的任务
+func scheduleJobs() {
+	maxConcurrent := getSettings().MaxConcurrentDownloads
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	// 正在替换yt-dlp，更新完成后再启动
+	if holdJobs {
+		return
+	}
+
+	running := countJobsLocked(JobRunning)
+	started := false
+	now := time.Now()
+	var nextRetry time.Time
+	for _, job := range jobs {
+		// 等待重试的任务到时间后才可以启动
+		if job.Status == JobRetrying && job.NextRetryAt != nil && job.NextRetryAt.After(now) {
+			if nextRetry.IsZero() || job.NextRetryAt.Before(nextRetry) {
+				nextRetry = *job.NextRetryAt
+			}
+			continue
+		}
+		if running >= maxConcurrent {
+			continue
+		}
+		if job.Status != JobQueued && job.Status != JobRetrying {
+			continue
+		}
+		startedAt := now
+		job.Status = JobRunning
+		job.StartedAt = &startedAt
+		job.FinishedAt = nil
+		job.NextRetryAt = nil
+		job.Error = ""
+		job.ExitCode = nil
+		job.Progress = nil
+		job.interrupt = ""
+		job.transient = ""
+		running++
+		started = true
+		sendTaskStatus(job.ID, JobRunning)
+		go runJob(job)
+	}
+
+	// 为最早到期的重试任务设置定时器
+	if retryTimer != nil {
+		retryTimer.Stop()
+		retryTimer = nil
+	}
+	if !nextRetry.IsZero() {
+		retryTimer = time.AfterFunc(time.Until(nextRetry), scheduleJobs)
+	}
+
+	if started {
+		saveQueueLocked()
+	}
+}
+
+// 记录本次运行的结果（调用方需持有jobsMu）
+func recordAttemptLocked(job *Job, status, errMsg string) {
+	attempt := JobAttempt{
+		Number:     len(job.Attempts) + 1,
+		FinishedAt: time.Now(),
+		Status:     status,
+		ExitCode:   job.ExitCode,
+		Error:      errMsg,
+		Transient:  job.transient,
+	}
+	if job.StartedAt != nil {
+		attempt.StartedAt = *job.StartedAt
+	}
+	job.Attempts = append(job.Attempts, attempt)
+}
+
+// 下载失败时根据重试策略决定是否自动重试，返回等待的时间和本次是第几次尝试
+func retryJob(job *Job, errMsg string) (time.Duration, int, bool) {
+	jobsMu.Lock()
+	if job.transient == "" {
+		jobsMu.Unlock()
+		return 0, 0, false
+	}
+
+	// 统计失败的次数（暂停、停止等用户操作不计入）
+	failures := 1
+	for _, attempt := range job.Attempts {
+		if attempt.Status == JobFailed || attempt.Status == JobRetrying {
+			failures++
+		}
+	}
+	if failures >= job.Retry.MaxAttempts {
+		jobsMu.Unlock()
+		return 0, 0, false
+	}
+
+	// 指数退避：BaseDelay * 2^(失败次数-1)，不超过MaxDelay
+	delay := time.Duration(job.Retry.BaseDelay) * time.Second
+	for i := 1; i < failures && delay < time.Duration(job.Retry.MaxDelay)*time.Second; i++ {
+		delay *= 2
+	}
+	if maxDelay := time.Duration(job.Retry.MaxDelay) * time.Second; delay > maxDelay {
+		delay = maxDelay
+	}
+
+	recordAttemptLocked(job, JobRetrying, errMsg)
+	nextRetryAt := time.Now().Add(delay)
+	job.Status = JobRetrying
+	job.Error = errMsg
+	job.NextRetryAt = &nextRetryAt
+	job.cmd = nil
+	saveQueueLocked()
+	jobsMu.Unlock()
+
+	sendTaskStatus(job.ID, JobRetrying)
+	scheduleJobs()
+	return delay, failures + 1, true
+}
+
+// 结束任务并记录最终状态，然后继续调度队列
+func finishJob(job *Job, status, errMsg string) {
+	jobsMu.Lock()
+	now := time.Now()
+	recordAttemptLocked(job, status, errMsg)
+	job.Status = status
+	job.Error = errMsg
+	job.cmd = nil
+	if isJobTerminal(status) {
+		job.FinishedAt = &now
+	}
+	// 下载完成后记录文件在视频库中的相对路径
+	if status == JobFinished && job.Filename != "" {
+		job.Filename = libraryRelativePath(job.Filename, job.Dir, argsTempDir(job.Args))
+	}
+	filename := job.Filename
+	dir := job.Dir
+	snapshot := *job
+	files := job.files
+	saveQueueLocked()
+	jobsMu.Unlock()
+
+	sendTaskStatus(job.ID, status)
+	if status == JobFinished {
+		// 保存yt-dlp写出的来源信息
+		stored := storeJobMetadata(snapshot, files)
+		for _, rel := range stored {
+			sendMessageToTask(job.ID, fmt.Sprintf("已保存来源信息: %s", rel), "log")
+		}
+		// 使用平台提供的视频封面作为缩略图
+		for _, rel := range storeJobThumbnails(snapshot, files) {
+			sendMessageToTask(job.ID, fmt.Sprintf("已保存视频封面: %s", rel), "log")
+		}
+		// overwrite时把相同视频的旧文件移到回收站
+		for _, rel := range replaceDuplicates(snapshot, stored) {
+			sendMessageToTask(job.ID, fmt.Sprintf("已将重复的旧文件移到回收站: %s", rel), "log")
+		}
+	}
+	if status == JobFinished && filename != "" {
+		publishLibraryEvent(LibraryEvent{Action: "added", Name: filepath.ToSlash(filename)})
+		// 在后台分析新下载文件的媒体信息并生成缩略图
+		if !filepath.IsAbs(filename) {
+			enqueueMediaProbe(filepath.Join(dir, filename))
+			if isVideoFile(filename) {
+				enqueueThumbnail(dir, filepath.ToSlash(filename))
+			}
+		}
+	}
+
+	scheduleJobs()
+}
+
+// 在后台运行单个下载任务
+func runJob(job *Job) {
+	taskID := job.ID
+
+	// 向任务相关的客户端发送开始运行的消息
+	sendMessageToTask(taskID, fmt.Sprintf("[%s] 开始运行yt-dlp...", time.Now().Format("2006-01-02 15:04:05")), "log")
+	sendMessageToTask(taskID, fmt.Sprintf("平台: %s", job.Platform), "log")
+	sendMessageToTask(taskID, fmt.Sprintf("URL: %s", job.URL), "log")
+
+	// 根据操作系统获取yt-dlp可执行文件路径（工作目录为视频库，需要使用绝对路径）
+	execPath := getExecutablePath("yt-dlp")
+	if absPath, err := filepath.Abs(execPath); err == nil {
+		execPath = absPath
+	}
+
+	// 队列文件中旧版本的任务没有记录下载目录
+	jobsMu.Lock()
+	if job.Dir == "" {
+		job.Dir = getLibraryRoot()
+	}
+	dir := job.Dir
+	jobsMu.Unlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		sendMessageToTask(taskID, fmt.Sprintf("错误：无法创建下载目录 - %v", err), "error")
+		finishJob(job, JobFailed, err.Error())
+		sendMessageToTask(taskID, "COMMAND_FINISHED", "complete")
+		return
+	}
+
+	// 按重复视频的处理方式调整本次运行的参数，清除上次尝试记录的文件
+	jobsMu.Lock()
+	job.Skipped = nil
+	job.files = nil
+	firstAttempt := len(job.Attempts) == 0
+	jobsMu.Unlock()
+	args, archivePath, libraryIndex := prepareDuplicateArgs(job, dir, firstAttempt)
+	if archivePath != "" {
+		defer os.Remove(archivePath)
+	}
+
+	// 显示完整的拼接命令
+	fullCommand := execPath
+	for _, arg := range args {
+		// 如果参数包含空格或特殊字符，用反引号包围
+		if strings.Contains(arg, " ") || strings.Contains(arg, "?") || strings.Contains(arg, "&") {
+			fullCommand += " `" + arg + "`"
+		} else {
+			fullCommand += " " + arg
+		}
+	}
+	sendMessageToTask(taskID, fmt.Sprintf("执行命令: %s", fullCommand), "log")
+
+	// 创建命令
+	cmd := exec.Command(execPath, args...)
+	// 设置工作目录为视频库根目录
+	cmd.Dir = dir
+	// 设置环境变量禁用缓冲
+	cmd.Env = append(os.Environ(), "PYTHONUNBUFFERED=1")
+
+	// 将stderr重定向到stdout，这样所有输出都从一个管道读取
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		sendMessageToTask(taskID, fmt.Sprintf("错误：无法获取标准输出 - %v", err), "error")
+		finishJob(job, JobFailed, err.Error())
+		sendMessageToTask(taskID, "COMMAND_FINISHED", "complete")
+		return
+	}
+	// 将stderr重定向到stdout
+	cmd.Stderr = cmd.Stdout
+
+	// 启动命令
+	if err := cmd.Start(); err != nil {
+		sendMessageToTask(taskID, fmt.Sprintf("错误：无法启动工具 - %v", err), "error")
+		finishJob(job, JobFailed, err.Error())
+		sendMessageToTask(taskID, "COMMAND_FINISHED", "complete")
+		return
+	}
+
+	// 保存任务命令引用
+	jobsMu.Lock()
+	job.cmd = cmd
+	jobsMu.Unlock()
+
+	// 使用WaitGroup确保goroutine完成
+	var wg sync.WaitGroup
+	wg.Add(1) // 一个goroutine处理所有输出
+
+	// 读取合并后的输出（stdout + stderr）
+	go func() {
+		defer wg.Done()
+		scanner := bufio.NewScanner(stdout)
+		// 设置更大的缓冲区以处理长行
+		scanner.Buffer(make([]byte, 64*1024), 64*1024)
+		// 播放列表中当前下载的条目位置
+		playlistIndex, playlistCount := 0, 0
+		// 最后一条ERROR输出和最近识别出的临时错误，用于判断失败后是否重试
+		lastError, transientHint := "", ""
+		defer func() {
+			transient := transientHint
+			if lastError != "" {
+				transient = classifyTransientError(lastError)
+			}
+			jobsMu.Lock()
+			job.transient = transient
+			jobsMu.Unlock()
+		}()
+		for scanner.Scan() {
+			text := convertGBKToUTF8(scanner.Text())
+
+			if strings.Contains(text, "ERROR:") {
+				lastError = text
+			}
+			if reason := classifyTransientError(text); reason != "" {
+				transientHint = reason
+			}
+
+			// 尝试从输出中提取文件名
+			if filename := extractFilename(text); filename != "" {
+				jobsMu.Lock()
+				job.Filename = filename
+				job.files = append(job.files, filename)
+				jobsMu.Unlock()
+				sendMessageToTask(taskID, fmt.Sprintf("检测到下载文件: %s", filename), "log")
+			}
+
+			// 视频库中已有的视频被yt-dlp跳过
+			if m := archiveSkipRe.FindStringSubmatch(text); len(m) > 1 {
+				existing := strings.Join(libraryIndex.ByTitle[m[1]], ", ")
+				if existing == "" {
+					existing = m[1]
+				}
+				jobsMu.Lock()
+				job.Skipped = append(job.Skipped, existing)
+				jobsMu.Unlock()
+				sendMessageToTask(taskID, fmt.Sprintf("视频库中已有相同视频，已跳过: %s", existing), "log")
+			}
+
+			// 记录播放列表位置并解析下载进度
+			if index, count, ok := parsePlaylistItem(text); ok {
+				playlistIndex, playlistCount = index, count
+			}
+			if progress, ok := parseProgress(text); ok {
+				progress.PlaylistIndex = playlistIndex
+				progress.PlaylistCount = playlistCount
+				jobsMu.Lock()
+				job.Progress = &progress
+				jobsMu.Unlock()
+				sendProgressToTask(taskID, progress)
+			}
+
+			// 立即发送消息，不等待缓冲
+			sendMessageToTask(taskID, text, "log")
+		}
+		if err := scanner.Err(); err != nil {
+			sendMessageToTask(taskID, fmt.Sprintf("错误：读取输出失败 - %v", err), "error")
+		}
+	}()
+
+	// 等待所有输出读取完成后再等待命令结束
+	wg.Wait()
+	cmdErr := cmd.Wait()
+
+	// 记录退出码
+	if cmd.ProcessState != nil {
+		exitCode := cmd.ProcessState.ExitCode()
+		jobsMu.Lock()
+		job.ExitCode = &exitCode
+		jobsMu.Unlock()
+	}
+
+	// 用户手动停止或暂停的任务由handleStop/handlePause负责清理和通知
+	jobsMu.Lock()
+	interrupt := job.interrupt
+	jobsMu.Unlock()
+	if interrupt != "" {
+		finishJob(job, interrupt, "")
+		return
+	}
+
+	// 发送完成消息
+	if cmdErr != nil {
+		// 临时错误按重试策略自动重新排队
+		if delay, attempt, ok := retryJob(job, cmdErr.Error()); ok {
+			sendMessageToTask(taskID, fmt.Sprintf("[%s] 下载失败（%v），识别为临时错误，将在 %d 秒后进行第 %d/%d 次尝试", time.Now().Format("2006-01-02 15:04:05"), cmdErr, int(delay.Seconds()), attempt, job.Retry.MaxAttempts), "error")
+			return
+		}
+		finishJob(job, JobFailed, cmdErr.Error())
+		sendMessageToTask(taskID, fmt.Sprintf("命令执行完成，但有错误：%v", cmdErr), "error")
+	} else {
+		finishJob(job, JobFinished, "")
+		sendMessageToTask(taskID, fmt.Sprintf("[%s] 命令执行完成", time.Now().Format("2006-01-02 15:04:05")), "complete")
+	}
+	sendMessageToTask(taskID, "COMMAND_FINISHED", "complete") // 发送完成信号
+}
+
+// 追加任务日志，只保留最近的maxJobLogLines行
+func appendJobLog(taskID, message string) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	job := findJobLocked(taskID)
+	if job == nil {
+		return
+	}
+	job.Logs = append(job.Logs, message)
+	if len(job.Logs) > maxJobLogLines {
+		job.Logs = job.Logs[len(job.Logs)-maxJobLogLines:]
+	}
+}
+
+// 复制任务记录并截取最近的日志行（调用方需持有jobsMu）
+func snapshotJobLocked(job *Job, lines int) Job {
+	snapshot := *job
+	snapshot.cmd = nil
+	snapshot.Args = append([]string(nil), job.Args...)
+	if lines < 0 {
+		lines = 0
+	}
+	start := len(job.Logs) - lines
+	if start < 0 {
+		start = 0
+	}
+	snapshot.Logs = append([]string{}, job.Logs[start:]...)
+	return snapshot
+}
+
+// 解析日志行数参数
+func parseLogLines(r *http.Request, defaultLines int) int {
+	lines := defaultLines
+	if value := r.URL.Query().Get("lines"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+			lines = n
+		}
+	}
+	if lines > maxJobLogLines {
+		lines = maxJobLogLines
+	}
+	return lines
+}
+
+// 处理任务列表API请求
+func handleTaskList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 可选的状态过滤，例如 ?status=queued,running
+	statusFilter := make(map[string]bool)
+	if value := r.URL.Query().Get("status"); value != "" {
+		for _, status := range strings.Split(value, ",") {
+			if status = strings.TrimSpace(status); status != "" {
+				statusFilter[status] = true
+			}
+		}
+	}
+	lines := parseLogLines(r, 20)
+
+	jobsMu.Lock()
+	tasks := make([]Job, 0, len(jobs))
+	for _, job := range jobs {
+		if len(statusFilter) > 0 && !statusFilter[job.Status] {
+			continue
+		}
+		tasks = append(tasks, snapshotJobLocked(job, lines))
+	}
+	jobsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(tasks)
+}
+
+// 处理单个任务详情API请求
+func handleTaskDetail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 从URL路径中提取任务ID
+	taskID, err := libraryPathFromURL(r, "/api/tasks/")
+	if err != nil || taskID == "" {
+		http.Error(w, "TaskID not provided", http.StatusBadRequest)
+		return
+	}
+	lines := parseLogLines(r, maxJobLogLines)
+
+	jobsMu.Lock()
+	job := findJobLocked(taskID)
+	if job == nil {
+		jobsMu.Unlock()
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	task := snapshotJobLocked(job, lines)
+	jobsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(task)
+}
+
+// 从浏览器读取Cookie时支持的浏览器
+var cookieBrowsers = map[string]bool{
+	"brave": true, "chrome": true, "chromium": true, "edge": true, "firefox": true,
+	"opera": true, "safari": true, "vivaldi": true, "whale": true,
+}
+
+// Cookie文件的站点名，例如 "youtube.com"
+var cookieSiteRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.\-]*$`)
+
+// Cookie文件信息
+type CookieFileInfo struct {
+	Site    string    `json:"site"`
+	Size    int64     `json:"size"`
+	Cookies int       `json:"cookies"` // 文件中的Cookie条数
+	ModTime time.Time `json:"modTime"`
+}
+
+// Cookie删除请求结构体
+type CookieDeleteRequest struct {
+	Site string `json:"site"`
+}
+
+// 获取站点Cookie文件的路径
+func cookieFilePath(site string) string {
+	return filepath.Join(cookiesDir, strings.ToLower(site)+".txt")
+}
+
+// 统计Netscape格式cookies.txt中的Cookie条数，格式不正确时返回错误
+func countNetscapeCookies(data []byte) (int, error) {
+	count := 0
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "#HttpOnly_") {
+			line = strings.TrimPrefix(line, "#HttpOnly_")
+		} else if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if len(strings.Split(line, "\t")) != 7 {
+			return 0, fmt.Errorf("第%d行不是有效的Netscape Cookie格式", i+1)
+		}
+		count++
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("文件中没有Cookie")
+	}
+	return count, nil
+}
+
+// 根据URL的主机名查找匹配的Cookie文件（选择最长匹配的站点）
+func findCookieSite(videoURL string) string {
+	parsedURL, err := url.Parse(videoURL)
+	if err != nil {
+		return ""
+	}
+	host := strings.ToLower(parsedURL.Hostname())
+
+	entries, err := os.ReadDir(cookiesDir)
+	if err != nil {
+		return ""
+	}
+	best := ""
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".txt") {
+			continue
+		}
+		site := strings.TrimSuffix(entry.Name(), ".txt")
+		if (host == site || strings.HasSuffix(host, "."+site)) && len(site) > len(best) {
+			best = site
+		}
+	}
+	return best
+}
+
+// 根据配置构建Cookie参数
+func buildCookieArgs(config Config, videoURL string) ([]string, error) {
+	switch config.CookieMode {
+	case "none":
+		return nil, nil
+	case "", "browser":
+		// 未配置时沿用从Firefox读取Cookie的默认行为
+		browser := strings.ToLower(config.CookieBrowser)
+		if browser == "" {
+			browser = "firefox"
+		}
+		if !cookieBrowsers[browser] {
+			return nil, fmt.Errorf("不支持的浏览器: %s", config.CookieBrowser)
+		}
+		if config.CookieProfile != "" {
+			if strings.Contains(config.CookieProfile, "::") {
+				return nil, fmt.Errorf("无效的浏览器配置文件: %s", config.CookieProfile)
+			}
+			browser += ":" + config.CookieProfile
+		}
+		return []string{"--cookies-from-browser", browser}, nil
+	case "file":
+		site := config.CookieSite
+		if site == "" {
+			site = findCookieSite(videoURL)
+			if site == "" {
+				return nil, fmt.Errorf("没有找到与该网址匹配的Cookie文件")
+			}
+		} else if !cookieSiteRe.MatchString(site) {
+			return nil, fmt.Errorf("无效的站点名: %s", site)
+		}
+		path, err := filepath.Abs(cookieFilePath(site))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("站点 %s 的Cookie文件不存在", site)
+		}
+		return []string{"--cookies", path}, nil
+	default:
+		return nil, fmt.Errorf("无效的Cookie来源: %s", config.CookieMode)
+	}
+}
+
+// 处理Cookie文件列表请求
+func handleCookieList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	files := []CookieFileInfo{}
+	entries, err := os.ReadDir(cookiesDir)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, "Failed to read cookies directory", http.StatusInternalServerError)
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".txt") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(cookiesDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		count, _ := countNetscapeCookies(data)
+		files = append(files, CookieFileInfo{
+			Site:    strings.TrimSuffix(entry.Name(), ".txt"),
+			Size:    info.Size(),
+			Cookies: count,
+			ModTime: info.ModTime(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(files)
+}
+
+// 处理Cookie文件上传请求（multipart表单：site站点名，file为Netscape格式的cookies.txt）
+func handleCookieUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxCookieFileSize+1024*1024)
+	if err := r.ParseMultipartForm(maxCookieFileSize); err != nil {
+		http.Error(w, "无效的上传请求", http.StatusBadRequest)
+		return
+	}
+
+	site := strings.ToLower(strings.TrimSpace(r.FormValue("site")))
+	if !cookieSiteRe.MatchString(site) {
+		http.Error(w, "无效的站点名", http.StatusBadRequest)
+		return
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "未提供Cookie文件", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxCookieFileSize+1))
+	if err != nil {
+		http.Error(w, "读取Cookie文件失败", http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxCookieFileSize {
+		http.Error(w, "Cookie文件过大", http.StatusRequestEntityTooLarge)
+		return
+	}
+	count, err := countNetscapeCookies(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := os.MkdirAll(cookiesDir, 0700); err != nil {
+		http.Error(w, "Failed to create cookies directory", http.StatusInternalServerError)
+		return
+	}
+	// 先写入临时文件再替换，避免正在运行的任务读到不完整的文件
+	path := cookieFilePath(site)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		http.Error(w, "Failed to save cookie file", http.StatusInternalServerError)
+		return
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		http.Error(w, "Failed to save cookie file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": fmt.Sprintf("已保存站点 %s 的Cookie（%d条）", site, count),
+		"site":    site,
+		"cookies": count,
+	})
+}
+
+// 处理Cookie文件删除请求
+func handleCookieDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CookieDeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !cookieSiteRe.MatchString(req.Site) {
+		http.Error(w, "无效的站点名", http.StatusBadRequest)
+		return
+	}
+
+	if err := os.Remove(cookieFilePath(req.Site)); err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Cookie文件不存在", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to delete cookie file", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Cookie文件已删除"})
+}
+
+// 运行yt-dlp -J获取视频或播放列表的元数据
+func probeURL(ctx context.Context, videoURL string, cookieArgs []string) (*ytdlpInfo, error) {
+	execPath := getExecutablePath("yt-dlp")
+	// 播放列表只获取条目列表，不逐个解析，避免耗时过长
+	args := append([]string{"-J", "--flat-playlist", "--no-warnings"}, cookieArgs...)
+	args = append(args, videoURL)
+
+	cmd := exec.CommandContext(ctx, execPath, args...)
+	cmd.Env = append(os.Environ(), "PYTHONUNBUFFERED=1")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("获取视频信息超时")
+		}
+		message := strings.TrimSpace(convertGBKToUTF8(stderr.String()))
+		if message == "" {
+			message = err.Error()
+		}
+		return nil, fmt.Errorf("获取视频信息失败: %s", message)
+	}
+
+	var info ytdlpInfo
+	if err := json.Unmarshal(output, &info); err != nil {
+		return nil, fmt.Errorf("解析视频信息失败: %v", err)
+	}
+	return &info, nil
+}
+
+// 将yt-dlp的元数据整理为预览结果
+func buildProbeResult(info *ytdlpInfo) ProbeResult {
+	result := ProbeResult{
+		ID:         info.ID,
+		Title:      info.Title,
+		Uploader:   info.Uploader,
+		Duration:   info.Duration,
+		Thumbnail:  info.Thumbnail,
+		WebpageURL: info.WebpageURL,
+		Extractor:  info.Extractor,
+		IsPlaylist: info.Type == "playlist",
+		Entries:    make([]ProbeEntry, 0, len(info.Entries)),
+		Formats:    make([]ProbeFormat, 0, len(info.Formats)),
+	}
+
+	for i, entry := range info.Entries {
+		if entry == nil {
+			continue
+		}
+		entryURL := entry.WebpageURL
+		if entryURL == "" {
+			entryURL = entry.URL
+		}
+		result.Entries = append(result.Entries, ProbeEntry{
+			Index:    i + 1,
+			ID:       entry.ID,
+			Title:    entry.Title,
+			URL:      entryURL,
+			Duration: entry.Duration,
+			Uploader: entry.Uploader,
+		})
+	}
+
+	for _, f := range info.Formats {
+		result.Formats = append(result.Formats, ProbeFormat{
+			FormatID:       f.FormatID,
+			Ext:            f.Ext,
+			Resolution:     f.Resolution,
+			Width:          f.Width,
+			Height:         f.Height,
+			FPS:            f.FPS,
+			VCodec:         f.VCodec,
+			ACodec:         f.ACodec,
+			DynamicRange:   f.DynamicRange,
+			TBR:            f.TBR,
+			Filesize:       int64(f.Filesize),
+			FilesizeApprox: int64(f.FilesizeApprox),
+			FormatNote:     f.FormatNote,
+		})
+	}
+
+	return result
+}
+
+// 处理元数据预览API请求
+func handleProbe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只允许POST请求", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ProbeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "无效的JSON参数", http.StatusBadRequest)
+		return
+	}
+
+	if req.URL == "" {
+		http.Error(w, "URL参数不能为空", http.StatusBadRequest)
+		return
+	}
+
+	applyRuleCookies(&req.Config, detectRule(getRules(), req.URL))
+	cookieArgs, err := buildCookieArgs(req.Config, req.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 90*time.Second)
+	defer cancel()
+
+	info, err := probeURL(ctx, req.URL, cookieArgs)
+	if err != nil {
+		log.Printf("预览视频信息失败: %v", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(buildProbeResult(info))
+}
+
+// 处理预览图生成API请求
+func handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 从URL路径中提取相对视频库根目录的文件路径
+	decodedFilename, err := libraryPathFromURL(r, "/api/thumbnail/")
+	if err != nil {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	if decodedFilename == "" {
+		http.Error(w, "Filename not provided", http.StatusBadRequest)
+		return
+	}
+
+	// 获取视频库根目录
+	root := getLibraryRoot()
+
+	// 构建完整文件路径，防止路径遍历攻击
+	filePath, rel, err := resolveLibraryPath(root, decodedFilename)
+	if err != nil {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	// 检查文件是否存在
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+
+	// 生成预览图文件名
+	thumbnailPath := thumbnailPathFor(root, rel)
+
+	// 预览图已存在且比视频新，直接返回
+	if cacheIsFresh(thumbnailPath, info) {
+		http.ServeFile(w, r, thumbnailPath)
+		return
+	}
+	if thumbnailFailed(thumbnailTask{Root: root, Rel: rel}, info) {
+		http.Error(w, "Failed to generate thumbnail", http.StatusInternalServerError)
+		return
+	}
+
+	// 在后台生成预览图，生成期间返回占位图，完成后通过library主题通知客户端
+	enqueueThumbnail(root, rel)
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", "2")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusAccepted)
+	io.WriteString(w, thumbnailPlaceholderSVG)
+}
+
+// 缩略图后台生成：最多thumbnailWorkers个FFmpeg进程同时运行，同一视频的多个请求只生成一次
+const thumbnailWorkers = 2
+
+// 缩略图生成任务（雪碧图和动态预览也使用同一个队列）
+type thumbnailTask struct {
+	Root    string
+	Rel     string
+	Preview string // 动态预览的格式（webp、gif、mp4）
+	Sprite  int    // 雪碧图的帧数
+}
+
+// 任务的唯一键，同一视频的缩略图、各帧数的雪碧图和各格式的预览分别生成
+func (task thumbnailTask) key() string {
+	return fmt.Sprintf("%s#%s#%d", filepath.Join(task.Root, filepath.FromSlash(task.Rel)), task.Preview, task.Sprite)
+}
+
+// 任务生成的缓存文件路径
+func (task thumbnailTask) outputPath() string {
+	switch {
+	case task.Preview != "":
+		return previewPathFor(task.Root, task.Rel, task.Preview)
+	case task.Sprite > 0:
+		return spritePathFor(task.Root, task.Rel, task.Sprite)
+	}
+	return thumbnailPathFor(task.Root, task.Rel)
+}
+
+// 生成失败的记录（失败时视频的文件状态和时间）
+type thumbnailFailure struct {
+	Info fs.FileInfo
+	At   time.Time
+}
+
+// 生成失败后在这段时间内不再重试（视频变化或安装FFmpeg后立即重试）
+const thumbnailFailureTTL = 10 * time.Minute
+
+// 缓存文件生成时源视频的大小和修改时间，用于判断缓存是否过期
+type cacheStamp struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+var (
+	thumbnailPending  = make(map[string]bool)             // 等待或正在生成的任务
+	thumbnailFailures = make(map[string]thumbnailFailure) // 生成失败的任务
+	cacheStamps       = make(map[string]cacheStamp)       // 缓存文件（绝对路径）-> 生成时源视频的状态
+	thumbnailMu       sync.Mutex                          // 保护thumbnailPending、thumbnailFailures和cacheStamps的互斥锁
+	thumbnailQueue    = make(chan thumbnailTask, 4096)
+)
+
+// 加载缩略图缓存记录
+func loadThumbnailIndex() {
+	data, err := os.ReadFile(thumbnailIndexFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取缩略图索引失败: %v", err)
+		}
+		return
+	}
+
+	loaded := make(map[string]cacheStamp)
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		log.Printf("解析缩略图索引失败: %v", err)
+		return
+	}
+
+	thumbnailMu.Lock()
+	cacheStamps = loaded
+	thumbnailMu.Unlock()
+}
+
+// 保存缩略图缓存记录，删除已不存在的缓存文件（调用时需持有thumbnailMu）
+func saveThumbnailIndexLocked() {
+	for cachePath := range cacheStamps {
+		if _, err := os.Stat(cachePath); os.IsNotExist(err) {
+			delete(cacheStamps, cachePath)
+		}
+	}
+
+	data, err := json.Marshal(cacheStamps)
+	if err != nil {
+		log.Printf("序列化缩略图索引失败: %v", err)
+		return
+	}
+	tmpFile := thumbnailIndexFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		log.Printf("保存缩略图索引失败: %v", err)
+		return
+	}
+	if err := os.Rename(tmpFile, thumbnailIndexFile); err != nil {
+		log.Printf("保存缩略图索引失败: %v", err)
+	}
+}
+
+// 记录缓存文件对应的源视频状态
+func recordCacheStamp(cachePath string, source fs.FileInfo) {
+	thumbnailMu.Lock()
+	cacheStamps[cachePath] = cacheStamp{Size: source.Size(), ModTime: source.ModTime()}
+	thumbnailMu.Unlock()
+}
+
+// 清除所有生成失败的记录（安装FFmpeg后调用）
+func clearThumbnailFailures() {
+	thumbnailMu.Lock()
+	thumbnailFailures = make(map[string]thumbnailFailure)
+	thumbnailMu.Unlock()
+}
+
+// 缩略图生成期间返回的占位图
+const thumbnailPlaceholderSVG = `<svg xmlns="http://www.w3.org/2000/svg" width="320" height="180" viewBox="0 0 320 180">` +
+	`<rect width="320" height="180" fill="#e9ecef"/>` +
+	`<text x="160" y="96" text-anchor="middle" font-family="sans-serif" font-size="16" fill="#6c757d">生成中…</text></svg>`
+
+// 将视频加入缩略图生成队列
+func enqueueThumbnail(root, rel string) {
+	enqueueThumbnailTask(thumbnailTask{Root: root, Rel: rel})
+}
+
+// 将任务加入生成队列，已在队列中时忽略
+func enqueueThumbnailTask(task thumbnailTask) {
+	thumbnailMu.Lock()
+	defer thumbnailMu.Unlock()
+	if thumbnailPending[task.key()] {
+		return
+	}
+	select {
+	case thumbnailQueue <- task:
+		thumbnailPending[task.key()] = true
+	default:
+		// 队列已满，下次访问时再加入
+	}
+}
+
+// 检查任务在视频当前状态（大小和修改时间）下是否刚生成失败过
+func thumbnailFailed(task thumbnailTask, info fs.FileInfo) bool {
+	thumbnailMu.Lock()
+	defer thumbnailMu.Unlock()
+	failed, ok := thumbnailFailures[task.key()]
+	if !ok {
+		return false
+	}
+	if time.Since(failed.At) > thumbnailFailureTTL {
+		delete(thumbnailFailures, task.key())
+		return false
+	}
+	return failed.Info.Size() == info.Size() && failed.Info.ModTime().Equal(info.ModTime())
+}
 
-	// 构建ffmpeg命令进行实时转码
-	cmd := exec.Command(ffmpegPath,
+// 视频文件变化后删除旧的缩略图和预览缓存并重新生成
+func invalidateThumbnails(root, rel string) {
+	os.Remove(thumbnailPathFor(root, rel))
+	removeThumbnailVariants(root, rel)
+	enqueueThumbnail(root, rel)
+}
+
+// 缩略图生成工作协程，缩略图生成完成后通知订阅了library主题的客户端刷新
+func runThumbnailWorker() {
+	for task := range thumbnailQueue {
+		filePath := filepath.Join(task.Root, filepath.FromSlash(task.Rel))
+		outputPath := task.outputPath()
+		info, statErr := os.Stat(filePath)
+		var err error
+		generated := false
+		if statErr == nil && !cacheIsFresh(outputPath, info) {
+			switch {
+			case task.Preview != "":
+				err = generatePreview(filePath, outputPath, task.Preview, info)
+			case task.Sprite > 0:
+				err = generateSpriteFor(filePath, outputPath, task.Sprite, info)
+			default:
+				err = generateThumbnail(filePath, outputPath, info)
+			}
+			generated = err == nil
+		}
+
+		thumbnailMu.Lock()
+		delete(thumbnailPending, task.key())
+		if err != nil {
+			thumbnailFailures[task.key()] = thumbnailFailure{Info: info, At: time.Now()}
+		} else {
+			delete(thumbnailFailures, task.key())
+		}
+		if generated {
+			cacheStamps[outputPath] = cacheStamp{Size: info.Size(), ModTime: info.ModTime()}
+		}
+		if len(thumbnailQueue) == 0 {
+			saveThumbnailIndexLocked()
+		}
+		thumbnailMu.Unlock()
+
+		if err != nil {
+			log.Printf("生成缩略图失败 %s: %v", task.Rel, err)
+		} else if generated && task.Preview == "" && task.Sprite == 0 {
+			publishTopic(TopicLibrary, "thumbnail", LibraryEvent{Action: "thumbnail", Name: task.Rel})
+		}
+	}
+}
+
+// 缩略图取帧位置占视频时长的比例（避开片头的黑屏和标题）
+const thumbnailSeekRatio = 0.1
+
+// 生成视频的缩略图：优先使用视频旁边的同名封面图片，否则用FFmpeg的thumbnail滤镜
+// 在视频时长10%处附近挑选最有代表性的一帧（跳过黑屏和空白帧）
+func generateThumbnail(filePath, thumbnailPath string, info fs.FileInfo) error {
+	stem := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+	if imagePath := findSidecarFile([]string{filepath.Dir(filePath)}, stem, sidecarThumbnailExtensions...); imagePath != "" {
+		if err := convertThumbnailImage(imagePath, thumbnailPath); err == nil {
+			return nil
+		}
+	}
+
+	seek := 0.0
+	if media, err := mediaInfoFor(filePath, info); err == nil && media.Duration > 0 {
+		seek = media.Duration * thumbnailSeekRatio
+	}
+	err := extractThumbnailFrame(filePath, thumbnailPath, seek)
+	if err != nil && seek > 0 {
+		// 时长信息不准确时从头重试
+		err = extractThumbnailFrame(filePath, thumbnailPath, 0)
+	}
+	return err
+}
+
+// 从视频指定位置开始用thumbnail滤镜选取一帧保存为缩略图
+func extractThumbnailFrame(filePath, thumbnailPath string, seek float64) error {
+	return runThumbnailFFmpeg(thumbnailPath,
+		"-ss", fmt.Sprintf("%.3f", seek),
 		"-i", filePath,
-		"-c:v", "libx264",
-		"-c:a", "aac",
-		"-preset", "ultrafast",
-		"-tune", "zerolatency",
-		"-movflags", "frag_keyframe+empty_moov",
-		"-f", "mp4",
-		"pipe:1")
+		"-an", "-sn",
+		"-vf", "thumbnail,scale='min(320,iw)':-2",
+		"-frames:v", "1")
+}
 
-	// 设置命令的标准输出为HTTP响应
-	cmd.Stdout = w
-	cmd.Stderr = nil // 忽略错误输出
+// 把封面图片缩放为缩略图
+func convertThumbnailImage(imagePath, thumbnailPath string) error {
+	return runThumbnailFFmpeg(thumbnailPath,
+		"-i", imagePath,
+		"-vf", "scale='min(320,iw)':-2",
+		"-frames:v", "1")
+}
 
-	// 执行转码命令
-	if err := cmd.Run(); err != nil {
-		log.Printf("FFmpeg转码错误: %v", err)
-		// 如果转码失败，尝试直接提供原文件
-		http.ServeFile(w, r, filePath)
+// 运行FFmpeg生成缩略图，先写入临时文件，确认输出不为空后再替换缩略图
+func runThumbnailFFmpeg(thumbnailPath string, args ...string) error {
+	if err := os.MkdirAll(filepath.Dir(thumbnailPath), 0755); err != nil {
+		return err
+	}
+	tmpPath := strings.TrimSuffix(thumbnailPath, ".jpg") + ".tmp.jpg"
+	args = append(args, "-y", tmpPath)
+	output, err := exec.Command(getExecutablePath("ffmpeg"), args...).CombinedOutput()
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("%v: %s", err, lastLines(string(output), 3))
+	}
+	// 取帧位置超出视频长度时FFmpeg正常退出但不写出文件
+	if info, err := os.Stat(tmpPath); err != nil || info.Size() == 0 {
+		os.Remove(tmpPath)
+		return fmt.Errorf("ffmpeg没有输出图片: %s", lastLines(string(output), 3))
 	}
+	return os.Rename(tmpPath, thumbnailPath)
 }
 
-// 向所有WebSocket客户端广播消息
-// 向指定任务ID的客户端发送消息
-func sendMessageToTask(taskID, message, msgType string) {
-	clientsMu.Lock()
-	defer clientsMu.Unlock()
+// 获取文件的媒体信息，索引中没有时立即用ffprobe分析
+func mediaInfoFor(filePath string, info fs.FileInfo) (*MediaInfo, error) {
+	if media := lookupMediaInfo(filePath, info); media != nil {
+		return media, nil
+	}
+	return probeMediaFile(filePath)
+}
 
-	wsMsg := WSMessage{
-		TaskID:  taskID,
-		Message: message,
-		Type:    msgType,
+// 预览图缓存文件的路径，suffix例如 "_sprite_20.jpg"（与缩略图保存在同一目录）
+func thumbnailVariantPath(root, rel, suffix string) string {
+	stem := strings.TrimSuffix(path.Base(rel), path.Ext(rel))
+	return filepath.Join(root, thumbnailsDirName, filepath.FromSlash(path.Dir(rel)), stem+suffix)
+}
+
+// 缩略图之外的预览缓存文件名前缀（雪碧图、动态预览），重命名或删除视频时一并清理
+var thumbnailVariantPrefixes = []string{"_sprite_", "_preview."}
+
+// 删除视频的雪碧图等预览缓存（可以重新生成，不随视频移动）
+func removeThumbnailVariants(root, rel string) {
+	dir := filepath.Dir(thumbnailPathFor(root, rel))
+	stem := strings.TrimSuffix(path.Base(rel), path.Ext(rel))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		for _, prefix := range thumbnailVariantPrefixes {
+			if strings.HasPrefix(entry.Name(), stem+prefix) {
+				os.Remove(filepath.Join(dir, entry.Name()))
+				break
+			}
+		}
+	}
+}
+
+// 检查缓存文件是否存在且对应源文件的当前内容
+func cacheIsFresh(cachePath string, source fs.FileInfo) bool {
+	info, err := os.Stat(cachePath)
+	if err != nil || info.Size() == 0 {
+		return false
+	}
+	// 有生成记录时比较源视频的大小和修改时间，没有记录（旧版本生成或随视频重命名）时只比较修改时间
+	thumbnailMu.Lock()
+	stamp, ok := cacheStamps[cachePath]
+	thumbnailMu.Unlock()
+	if ok {
+		return stamp.Size == source.Size() && stamp.ModTime.Equal(source.ModTime())
+	}
+	return !info.ModTime().Before(source.ModTime())
+}
+
+// 雪碧图参数
+const (
+	defaultSpriteFrames = 20  // 默认帧数
+	maxSpriteFrames     = 100 // 最多帧数
+	spriteTileWidth     = 160 // 每帧的宽度（像素）
+	minSpriteInterval   = 0.1 // 相邻两帧的最小间隔（秒），太短的视频减少帧数
+)
+
+// 雪碧图的布局：列数、行数和每帧的尺寸
+type spriteLayout struct {
+	Frames     int
+	Columns    int
+	Rows       int
+	TileWidth  int
+	TileHeight int
+	Interval   float64 // 相邻两帧间隔的秒数
+}
+
+// 根据视频尺寸和时长计算雪碧图布局，列数取帧数的平方根使图片接近正方形
+func newSpriteLayout(media *MediaInfo, frames int) spriteLayout {
+	interval := media.Duration / float64(frames)
+	if interval < minSpriteInterval {
+		interval = minSpriteInterval
+		frames = int(media.Duration / minSpriteInterval)
+		if frames < 1 {
+			frames = 1
+		}
+	}
+	layout := spriteLayout{Frames: frames, TileWidth: spriteTileWidth, Interval: interval}
+	layout.Columns = int(math.Ceil(math.Sqrt(float64(frames))))
+	layout.Rows = (frames + layout.Columns - 1) / layout.Columns
+	// 高度按比例缩放并取偶数，没有视频尺寸时按16:9计算
+	layout.TileHeight = spriteTileWidth * 9 / 16
+	if media.Width > 0 && media.Height > 0 {
+		layout.TileHeight = int(math.Round(float64(spriteTileWidth)*float64(media.Height)/float64(media.Width)/2)) * 2
+	}
+	return layout
+}
+
+// 获取雪碧图的缓存路径（与缩略图保存在同一目录）
+func spritePathFor(root, rel string, frames int) string {
+	return thumbnailVariantPath(root, rel, fmt.Sprintf("_sprite_%d.jpg", frames))
+}
+
+// 根据视频时长计算布局并生成雪碧图
+func generateSpriteFor(filePath, spritePath string, frames int, info fs.FileInfo) error {
+	media, err := mediaInfoFor(filePath, info)
+	if err != nil {
+		return err
+	}
+	if media.Duration <= 0 {
+		return fmt.Errorf("无法获取视频时长")
+	}
+	return generateSprite(filePath, spritePath, newSpriteLayout(media, frames))
+}
+
+// 使用FFmpeg生成雪碧图：按固定间隔取帧，缩放后拼接成网格
+func generateSprite(filePath, spritePath string, layout spriteLayout) error {
+	if err := os.MkdirAll(filepath.Dir(spritePath), 0755); err != nil {
+		return err
+	}
+	filter := fmt.Sprintf("fps=1/%.3f,scale=%d:%d,tile=%dx%d", layout.Interval, layout.TileWidth, layout.TileHeight, layout.Columns, layout.Rows)
+	tmpPath := strings.TrimSuffix(spritePath, ".jpg") + ".tmp.jpg"
+	cmd := exec.Command(getExecutablePath("ffmpeg"),
+		"-ss", fmt.Sprintf("%.3f", layout.Interval/2), // 每帧取各段的中间位置
+		"-i", filePath,
+		"-an", "-sn",
+		"-vf", filter,
+		"-frames:v", "1",
+		"-q:v", "5",
+		"-y", tmpPath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("%v: %s", err, lastLines(string(output), 3))
+	}
+	// ffmpeg没有取到任何帧时可能正常退出但输出空文件
+	if info, err := os.Stat(tmpPath); err != nil || info.Size() == 0 {
+		os.Remove(tmpPath)
+		return fmt.Errorf("生成的雪碧图为空")
+	}
+	return os.Rename(tmpPath, spritePath)
+}
+
+// 生成描述雪碧图中每帧位置的WebVTT缩略图轨道
+func buildSpriteVTT(layout spriteLayout, duration float64, spriteURL string) string {
+	var builder strings.Builder
+	builder.WriteString("WEBVTT\n\n")
+	for i := 0; i < layout.Frames; i++ {
+		start := float64(i) * layout.Interval
+		end := math.Min(start+layout.Interval, duration)
+		x := (i % layout.Columns) * layout.TileWidth
+		y := (i / layout.Columns) * layout.TileHeight
+		fmt.Fprintf(&builder, "%s --> %s\n%s#xywh=%d,%d,%d,%d\n\n",
+			formatVTTTime(start), formatVTTTime(end), spriteURL, x, y, layout.TileWidth, layout.TileHeight)
+	}
+	return builder.String()
+}
+
+// 格式化WebVTT时间戳，例如 "00:01:02.500"
+func formatVTTTime(seconds float64) string {
+	millis := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", millis/3600000, millis/60000%60, millis/1000%60, millis%1000)
+}
+
+// 获取输出的最后几行（用于错误信息）
+func lastLines(output string, n int) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, " ")
+}
+
+// 处理雪碧图请求：GET /api/sprite/{name}?frames=N 返回雪碧图，加 format=vtt 返回WebVTT缩略图轨道
+func handleSprite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	decodedFilename, err := libraryPathFromURL(r, "/api/sprite/")
+	if err != nil {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	if decodedFilename == "" {
+		http.Error(w, "Filename not provided", http.StatusBadRequest)
+		return
+	}
+
+	root := getLibraryRoot()
+	filePath, rel, err := resolveLibraryPath(root, decodedFilename)
+	if err != nil || !isVideoFile(rel) {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	frames := defaultSpriteFrames
+	if value := r.URL.Query().Get("frames"); value != "" {
+		if frames, err = strconv.Atoi(value); err != nil || frames < 1 || frames > maxSpriteFrames {
+			http.Error(w, fmt.Sprintf("frames必须在1到%d之间", maxSpriteFrames), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// 缓存在thumbnails目录中，源文件更新后重新生成；生成在后台队列中进行，期间返回202
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	task := thumbnailTask{Root: root, Rel: rel, Sprite: frames}
+	spritePath := task.outputPath()
+	if !cacheIsFresh(spritePath, info) {
+		if thumbnailFailed(task, info) {
+			http.Error(w, "Failed to generate sprite", http.StatusInternalServerError)
+			return
+		}
+		enqueueThumbnailTask(task)
+		w.Header().Set("Retry-After", "3")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "雪碧图生成中")
+		return
+	}
+
+	if r.URL.Query().Get("format") == "vtt" {
+		media, err := mediaInfoFor(filePath, info)
+		if err != nil || media.Duration <= 0 {
+			http.Error(w, "Failed to read video duration", http.StatusInternalServerError)
+			return
+		}
+		layout := newSpriteLayout(media, frames)
+		spriteURL := fmt.Sprintf("/api/sprite/%s?frames=%d", (&url.URL{Path: rel}).EscapedPath(), frames)
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+		w.Write([]byte(buildSpriteVTT(layout, media.Duration, spriteURL)))
+		return
+	}
+	http.ServeFile(w, r, spritePath)
+}
+
+// 动态预览参数
+const (
+	previewClips     = 5   // 截取的片段数
+	previewClipSecs  = 1.0 // 每个片段的秒数
+	previewWidth     = 240 // 预览宽度（像素）
+	previewFrameRate = 12  // 预览帧率
+)
+
+// 动态预览支持的格式及对应的MIME类型
+var previewFormats = map[string]string{
+	"mp4":  "video/mp4",
+	"webp": "image/webp",
+	"gif":  "image/gif",
+}
+
+// 获取视频动态预览的缓存路径（与缩略图保存在同一目录）
+func previewPathFor(root, rel, format string) string {
+	return thumbnailVariantPath(root, rel, "_preview."+format)
+}
+
+// 计算预览片段的起始时间：在视频10%到90%之间均匀分布，视频太短时减少片段数
+func previewClipStarts(duration float64) []float64 {
+	if duration <= previewClipSecs*2 {
+		return []float64{0}
+	}
+	clips := previewClips
+	if maxClips := int(duration / (previewClipSecs * 2)); maxClips < clips {
+		clips = maxClips
+	}
+	starts := make([]float64, clips)
+	span := duration * 0.8
+	for i := range starts {
+		starts[i] = duration*0.1 + span*(float64(i)+0.5)/float64(clips) - previewClipSecs/2
+	}
+	return starts
+}
+
+// 使用FFmpeg生成动态预览：截取几个1秒的片段，缩小并去掉声音后拼接成循环播放的短片
+func generatePreview(filePath, previewPath, format string, info fs.FileInfo) error {
+	if err := os.MkdirAll(filepath.Dir(previewPath), 0755); err != nil {
+		return err
+	}
+	duration := 0.0
+	if media, err := mediaInfoFor(filePath, info); err == nil {
+		duration = media.Duration
+	}
+	starts := previewClipStarts(duration)
+
+	var args []string
+	var filter strings.Builder
+	for i, start := range starts {
+		args = append(args, "-ss", fmt.Sprintf("%.3f", start), "-t", fmt.Sprintf("%.3f", previewClipSecs), "-i", filePath)
+		fmt.Fprintf(&filter, "[%d:v]fps=%d,scale=%d:-2,setsar=1,setpts=PTS-STARTPTS[v%d];", i, previewFrameRate, previewWidth, i)
+	}
+	for i := range starts {
+		fmt.Fprintf(&filter, "[v%d]", i)
+	}
+	fmt.Fprintf(&filter, "concat=n=%d:v=1:a=0", len(starts))
+
+	switch format {
+	case "gif":
+		// 使用调色板提高GIF画质
+		filter.WriteString(",split[a][b];[a]palettegen[p];[b][p]paletteuse")
+		args = append(args, "-filter_complex", filter.String(), "-loop", "0")
+	case "webp":
+		args = append(args, "-filter_complex", filter.String(), "-c:v", "libwebp", "-loop", "0", "-q:v", "60")
+	default:
+		args = append(args, "-filter_complex", filter.String(), "-c:v", "libx264", "-pix_fmt", "yuv420p", "-crf", "28", "-movflags", "+faststart")
+	}
+	args = append(args, "-an", "-sn")
+
+	tmpPath := strings.TrimSuffix(previewPath, "."+format) + ".tmp." + format
+	args = append(args, "-y", tmpPath)
+	output, err := exec.Command(getExecutablePath("ffmpeg"), args...).CombinedOutput()
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("%v: %s", err, lastLines(string(output), 3))
+	}
+	if info, err := os.Stat(tmpPath); err != nil || info.Size() == 0 {
+		os.Remove(tmpPath)
+		return fmt.Errorf("ffmpeg没有输出预览: %s", lastLines(string(output), 3))
+	}
+	return os.Rename(tmpPath, previewPath)
+}
+
+// 处理动态预览请求：/api/preview/{name}?format=mp4|webp|gif，还没有生成时在后台生成并返回202
+func handlePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	decodedFilename, err := libraryPathFromURL(r, "/api/preview/")
+	if err != nil {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	if decodedFilename == "" {
+		http.Error(w, "Filename not provided", http.StatusBadRequest)
+		return
+	}
+
+	root := getLibraryRoot()
+	filePath, rel, err := resolveLibraryPath(root, decodedFilename)
+	if err != nil || !isVideoFile(rel) {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		format = "mp4"
+	}
+	contentType, ok := previewFormats[format]
+	if !ok {
+		http.Error(w, "format必须是mp4、webp或gif", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	task := thumbnailTask{Root: root, Rel: rel, Preview: format}
+	previewPath := task.outputPath()
+	if cacheIsFresh(previewPath, info) {
+		w.Header().Set("Content-Type", contentType)
+		http.ServeFile(w, r, previewPath)
+		return
+	}
+	if thumbnailFailed(task, info) {
+		http.Error(w, "Failed to generate preview", http.StatusInternalServerError)
+		return
+	}
+
+	// 在后台生成，客户端稍后重试
+	enqueueThumbnailTask(task)
+	w.Header().Set("Retry-After", "3")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusAccepted)
+	io.WriteString(w, "预览生成中")
+}
+
+// 处理文件删除API请求
+func handleDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Filename string `json:"filename"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if req.Filename == "" {
+		http.Error(w, "Filename not provided", http.StatusBadRequest)
+		return
+	}
+
+	// 获取视频库根目录
+	root := getLibraryRoot()
+
+	// 构建完整文件路径，防止路径遍历攻击
+	filePath, filename, err := resolveLibraryPath(root, req.Filename)
+	if err != nil {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	// 检查文件是否存在，只能删除视频库中的媒体文件
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil || !isLibraryMediaFile(filename, info) {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	// 连同预览图和来源信息移到回收站
+	entry, err := moveToTrash(root, filename)
+	if err != nil {
+		http.Error(w, "Failed to delete file", http.StatusInternalServerError)
+		return
+	}
+
+	publishLibraryEvent(LibraryEvent{Action: "removed", Name: filename})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "trashID": entry.ID})
+}
+
+// 处理文件重命名API请求
+func handleRename(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		OldFilename string `json:"oldFilename"`
+		NewFilename string `json:"newFilename"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
 	}
 
-	sentCount := 0
-	for conn, clientInfo := range clients {
-		if clientInfo.TaskID == taskID {
-			err := conn.WriteJSON(wsMsg)
-			if err != nil {
-				log.Printf("发送消息错误: %v", err)
-				conn.Close()
-				delete(clients, conn)
-			} else {
-				sentCount++
-			}
-		}
+	if req.OldFilename == "" || req.NewFilename == "" {
+		http.Error(w, "Filenames not provided", http.StatusBadRequest)
+		return
 	}
 
-	log.Printf("向任务 %s 发送消息: %s (发送给 %d 个客户端)", taskID, message, sentCount)
-}
+	// 获取视频库根目录
+	root := getLibraryRoot()
 
-// 兼容性函数：广播消息给所有客户端（用于系统消息）
-func broadcastMessage(message string) {
-	clientsMu.Lock()
-	defer clientsMu.Unlock()
+	// 构建完整文件路径，防止路径遍历攻击
+	oldPath, oldFilename, err := resolveLibraryPath(root, req.OldFilename)
+	if err != nil {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	// 新文件名不包含目录时保持在原目录中
+	newFilename := strings.ReplaceAll(req.NewFilename, "\\", "/")
+	if !strings.Contains(newFilename, "/") && path.Dir(oldFilename) != "." {
+		newFilename = path.Dir(oldFilename) + "/" + newFilename
+	}
 
-	wsMsg := WSMessage{
-		TaskID:  "",
-		Message: message,
-		Type:    "system",
+	// 获取原文件的扩展名
+	oldExt := filepath.Ext(oldFilename)
+	
+	// 如果新文件名没有扩展名，则使用原文件的扩展名
+	if filepath.Ext(newFilename) == "" {
+		newFilename += oldExt
 	}
 
-	log.Printf("系统广播消息: %s (客户端数量: %d)", message, len(clients))
+	newPath, newFilename, err := resolveLibraryPath(root, newFilename)
+	if err != nil || mediaKindOf(newFilename) == "" {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
 
-	for conn := range clients {
-		err := conn.WriteJSON(wsMsg)
-		if err != nil {
-			log.Printf("发送消息错误: %v", err)
-			conn.Close()
-			delete(clients, conn)
-		}
+	// 检查原文件是否存在，且是视频库中的媒体文件
+	oldInfo, err := os.Stat(oldPath)
+	if os.IsNotExist(err) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil || !isLibraryMediaFile(oldFilename, oldInfo) {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
 	}
-}
 
-// 处理运行yt-dlp的请求
-func handleRun(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "只允许POST请求", http.StatusMethodNotAllowed)
+	// 检查新文件名是否已存在
+	if _, err := os.Stat(newPath); err == nil {
+		http.Error(w, "File with new name already exists", http.StatusConflict)
 		return
 	}
 
-	// 解析请求参数
-	var req RunRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "无效的JSON参数", http.StatusBadRequest)
+	// 重命名文件（移动到其他目录时自动创建目录）
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		http.Error(w, "Failed to create directory", http.StatusInternalServerError)
+		return
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		http.Error(w, "Failed to rename file", http.StatusInternalServerError)
 		return
 	}
+	moveLibraryEntries(root, oldFilename, newFilename)
 
-	// 验证参数
-	if req.Platform == "" || req.URL == "" || req.TaskID == "" {
-		http.Error(w, "平台、URL和任务ID参数不能为空", http.StatusBadRequest)
+	publishLibraryEvent(LibraryEvent{Action: "renamed", Name: newFilename, OldName: oldFilename})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "newName": newFilename})
+}
+
+// 处理批量删除API请求
+func handleBatchDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// 设置默认视频格式
-	if req.VideoFormat == "" {
-		req.VideoFormat = "mp4"
+	var req struct {
+		Filenames []string `json:"filenames"`
 	}
 
-	// 检查任务ID是否已存在
-	tasksMu.Lock()
-	if _, exists := activeTasks[req.TaskID]; exists {
-		tasksMu.Unlock()
-		http.Error(w, "任务ID已存在，请使用不同的任务ID", http.StatusConflict)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
-	tasksMu.Unlock()
 
-	// 向任务相关的客户端发送开始运行的消息
-	sendMessageToTask(req.TaskID, fmt.Sprintf("[%s] 开始运行yt-dlp...", time.Now().Format("2006-01-02 15:04:05")), "log")
-	sendMessageToTask(req.TaskID, fmt.Sprintf("平台: %s", req.Platform), "log")
-	sendMessageToTask(req.TaskID, fmt.Sprintf("URL: %s", req.URL), "log")
+	if len(req.Filenames) == 0 {
+		http.Error(w, "No filenames provided", http.StatusBadRequest)
+		return
+	}
 
-	// 在后台运行yt-dlp
-	go func() {
-		// 根据操作系统获取yt-dlp可执行文件路径
-		execPath := getExecutablePath("yt-dlp")
+	// 获取视频库根目录
+	root := getLibraryRoot()
 
-		// 根据是否启用高级选项构建命令参数
-		var args []string
-		if req.Config.EnableAdvanced {
-			args = buildAdvancedCommandArgs(req.Config, req.URL, req.VideoFormat)
-		} else {
-			args = buildCommandArgs(req.Platform, req.URL, req.VideoFormat)
+	var deletedFiles []string
+	var failedFiles []string
+
+	for _, filename := range req.Filenames {
+		// 构建完整文件路径，防止路径遍历攻击
+		filePath, cleanFilename, err := resolveLibraryPath(root, filename)
+		if err != nil {
+			failedFiles = append(failedFiles, filename)
+			continue
 		}
 
-		// 显示完整的拼接命令
-		fullCommand := execPath
-		for _, arg := range args {
-			// 如果参数包含空格或特殊字符，用反引号包围
-			if strings.Contains(arg, " ") || strings.Contains(arg, "?") || strings.Contains(arg, "&") {
-				fullCommand += " `" + arg + "`"
+		// 检查文件是否存在并移到回收站（只能删除媒体文件）
+		if info, err := os.Stat(filePath); err == nil && isLibraryMediaFile(cleanFilename, info) {
+			if _, err := moveToTrash(root, cleanFilename); err == nil {
+				deletedFiles = append(deletedFiles, cleanFilename)
+				publishLibraryEvent(LibraryEvent{Action: "removed", Name: cleanFilename})
 			} else {
-				fullCommand += " " + arg
+				failedFiles = append(failedFiles, cleanFilename)
 			}
+		} else {
+			failedFiles = append(failedFiles, cleanFilename)
 		}
-		sendMessageToTask(req.TaskID, fmt.Sprintf("执行命令: %s", fullCommand), "log")
+	}
 
-		// 创建命令
-		cmd := exec.Command(execPath, args...)
-		// 设置工作目录为当前目录
-		cmd.Dir = "."
-		// 设置环境变量禁用缓冲
-		cmd.Env = append(os.Environ(), "PYTHONUNBUFFERED=1")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      true,
+		"deleted":      deletedFiles,
+		"failed":       failedFiles,
+		"deletedCount": len(deletedFiles),
+		"failedCount":  len(failedFiles),
+	})
+}
 
-		// 保存任务命令引用和视频格式
-		tasksMu.Lock()
-		activeTasks[req.TaskID] = cmd
-		tasksMu.Unlock()
+// 回收站中的一条记录（删除的文件及其预览图、来源信息保存在 .trash/<id>/ 目录中）
+type TrashEntry struct {
+	ID           string          `json:"id"`
+	Name         string          `json:"name"` // 删除前相对视频库根目录的路径
+	Kind         string          `json:"kind"`
+	Size         int64           `json:"size"`
+	DeletedAt    time.Time       `json:"deletedAt"`
+	HasThumbnail bool            `json:"hasThumbnail"`
+	Media        *MediaInfo      `json:"media,omitempty"`
+	Metadata     *SourceMetadata `json:"metadata,omitempty"` // 来源信息（不含完整的info json）
+}
 
-		formatsMu.Lock()
-		taskFormats[req.TaskID] = req.VideoFormat
-		formatsMu.Unlock()
+// 回收站清单
+type TrashManifest struct {
+	Entries []*TrashEntry `json:"entries"`
+}
 
-		// 将stderr重定向到stdout，这样所有输出都从一个管道读取
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			sendMessageToTask(req.TaskID, fmt.Sprintf("错误：无法获取标准输出 - %v", err), "error")
-			return
-		}
-		// 将stderr重定向到stdout
-		cmd.Stderr = cmd.Stdout
+// 回收站操作请求
+type TrashRequest struct {
+	IDs []string `json:"ids"`
+	All bool     `json:"all"` // 清空回收站（仅用于purge）
+}
 
-		// 启动命令
-		if err := cmd.Start(); err != nil {
-			sendMessageToTask(req.TaskID, fmt.Sprintf("错误：无法启动工具 - %v", err), "error")
-			return
-		}
+const (
+	trashDirName      = ".trash"        // 视频库根目录下的回收站目录（隐藏目录，扫描时忽略）
+	trashManifestName = "manifest.json" // 回收站清单文件
+	trashMetadataName = "metadata.json" // 回收站中保存的来源信息
+	trashThumbnail    = "thumbnail.jpg" // 回收站中保存的预览图
+)
 
-		// 使用WaitGroup确保goroutine完成
-		var wg sync.WaitGroup
-		wg.Add(1) // 一个goroutine处理所有输出
-
-		// 读取合并后的输出（stdout + stderr）
-		go func() {
-			defer wg.Done()
-			scanner := bufio.NewScanner(stdout)
-			// 设置更大的缓冲区以处理长行
-			scanner.Buffer(make([]byte, 64*1024), 64*1024)
-			for scanner.Scan() {
-				text := convertGBKToUTF8(scanner.Text())
-
-				// 尝试从输出中提取文件名
-				if filename := extractFilename(text); filename != "" {
-					filesMu.Lock()
-					taskFiles[req.TaskID] = filename
-					filesMu.Unlock()
-					sendMessageToTask(req.TaskID, fmt.Sprintf("检测到下载文件: %s", filename), "progress")
-				}
+var (
+	trashMu      sync.Mutex // 保护回收站清单的互斥锁
+	trashCounter int64      // 生成回收站记录ID（由trashMu保护）
+)
 
-				// 立即发送消息，不等待缓冲
-				sendMessageToTask(req.TaskID, text, "log")
-			}
-			if err := scanner.Err(); err != nil {
-				sendMessageToTask(req.TaskID, fmt.Sprintf("错误：读取输出失败 - %v", err), "error")
-			}
-		}()
+// 读取回收站清单，调用方需持有trashMu
+func loadTrashManifestLocked(root string) (*TrashManifest, error) {
+	manifest := &TrashManifest{Entries: []*TrashEntry{}}
+	data, err := os.ReadFile(filepath.Join(root, trashDirName, trashManifestName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return manifest, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// 保存回收站清单，调用方需持有trashMu
+func saveTrashManifestLocked(root string, manifest *TrashManifest) error {
+	manifestPath := filepath.Join(root, trashDirName, trashManifestName)
+	if err := os.MkdirAll(filepath.Dir(manifestPath), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := manifestPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, manifestPath)
+}
 
-		// 等待命令完成
-		cmdErr := cmd.Wait()
+// 将视频库中的文件连同预览图和来源信息移到回收站
+func moveToTrash(root, rel string) (*TrashEntry, error) {
+	filePath := filepath.Join(root, filepath.FromSlash(rel))
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if !isLibraryMediaFile(rel, info) {
+		return nil, fmt.Errorf("%s 不是视频库中的媒体文件", rel)
+	}
 
-		// 清理任务引用、文件名和视频格式
-		tasksMu.Lock()
-		delete(activeTasks, req.TaskID)
-		tasksMu.Unlock()
+	trashMu.Lock()
+	defer trashMu.Unlock()
 
-		filesMu.Lock()
-		delete(taskFiles, req.TaskID)
-		filesMu.Unlock()
+	manifest, err := loadTrashManifestLocked(root)
+	if err != nil {
+		return nil, err
+	}
 
-		formatsMu.Lock()
-		delete(taskFormats, req.TaskID)
-		formatsMu.Unlock()
+	trashCounter++
+	entry := &TrashEntry{
+		ID:        fmt.Sprintf("%d-%d", time.Now().UnixNano(), trashCounter),
+		Name:      rel,
+		Kind:      mediaKindOf(rel),
+		Size:      info.Size(),
+		DeletedAt: time.Now(),
+	}
+	if entry.Kind != MediaKindSubtitle {
+		entry.Media = lookupMediaInfo(filePath, info)
+	}
 
-		// 等待所有输出读取完成
-		wg.Wait()
+	entryDir := filepath.Join(root, trashDirName, entry.ID)
+	if err := os.MkdirAll(entryDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(filePath, filepath.Join(entryDir, path.Base(rel))); err != nil {
+		os.Remove(entryDir)
+		return nil, err
+	}
 
-		// 发送完成消息
-		if cmdErr != nil {
-			sendMessageToTask(req.TaskID, fmt.Sprintf("命令执行完成，但有错误：%v", cmdErr), "error")
-		} else {
-			sendMessageToTask(req.TaskID, fmt.Sprintf("[%s] 命令执行完成", time.Now().Format("2006-01-02 15:04:05")), "complete")
+	// 预览图和来源信息移动失败不影响删除，雪碧图等预览缓存直接删除
+	removeThumbnailVariants(root, rel)
+	if err := os.Rename(thumbnailPathFor(root, rel), filepath.Join(entryDir, trashThumbnail)); err == nil {
+		entry.HasThumbnail = true
+	}
+	if metadata, err := readSourceMetadata(root, rel); err == nil {
+		if os.Rename(metadataPathFor(root, rel), filepath.Join(entryDir, trashMetadataName)) == nil {
+			metadata.Info = nil
+			entry.Metadata = metadata
 		}
-		sendMessageToTask(req.TaskID, "COMMAND_FINISHED", "complete") // 发送完成信号
-	}()
+	}
 
-	// 返回成功响应
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("命令已启动"))
+	manifest.Entries = append(manifest.Entries, entry)
+	if err := saveTrashManifestLocked(root, manifest); err != nil {
+		log.Printf("保存回收站清单失败: %v", err)
+	}
+	return entry, nil
 }
 
-// 处理预览图生成API请求
-func handleThumbnail(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// 从回收站恢复文件到原来的位置，原位置已有同名文件时返回错误
+func restoreFromTrashLocked(root string, entry *TrashEntry) error {
+	filePath, rel, err := resolveLibraryPath(root, entry.Name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filePath); err == nil {
+		return fmt.Errorf("原位置已存在同名文件")
 	}
 
-	// 从URL路径中提取文件名
-	filename := strings.TrimPrefix(r.URL.Path, "/api/thumbnail/")
-	if filename == "" {
-		http.Error(w, "Filename not provided", http.StatusBadRequest)
-		return
+	entryDir := filepath.Join(root, trashDirName, entry.ID)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(entryDir, path.Base(rel)), filePath); err != nil {
+		return err
 	}
 
-	// URL解码文件名
-	decodedFilename, err := url.QueryUnescape(filename)
-	if err != nil {
-		http.Error(w, "Invalid filename", http.StatusBadRequest)
-		return
+	if entry.HasThumbnail {
+		thumbnailPath := thumbnailPathFor(root, rel)
+		if os.MkdirAll(filepath.Dir(thumbnailPath), 0755) == nil {
+			os.Rename(filepath.Join(entryDir, trashThumbnail), thumbnailPath)
+		}
 	}
+	if entry.Metadata != nil {
+		metadataPath := metadataPathFor(root, rel)
+		if os.MkdirAll(filepath.Dir(metadataPath), 0755) == nil {
+			os.Rename(filepath.Join(entryDir, trashMetadataName), metadataPath)
+		}
+	}
+	return os.RemoveAll(entryDir)
+}
 
-	// 获取基础文件名，防止路径遍历攻击
-	decodedFilename = filepath.Base(decodedFilename)
+// 按ID处理回收站记录，返回处理成功和失败的ID；purge为true时永久删除，否则恢复
+func processTrashEntries(root string, req TrashRequest, purge bool) ([]*TrashEntry, map[string]string, error) {
+	trashMu.Lock()
+	defer trashMu.Unlock()
 
-	// 获取当前工作目录
-	cwd, err := os.Getwd()
+	manifest, err := loadTrashManifestLocked(root)
 	if err != nil {
-		http.Error(w, "Failed to get working directory", http.StatusInternalServerError)
-		return
+		return nil, nil, err
 	}
 
-	// 构建完整文件路径
-	filePath := filepath.Join(cwd, decodedFilename)
+	selected := make(map[string]bool)
+	for _, id := range req.IDs {
+		selected[id] = true
+	}
 
-	// 检查文件是否存在
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		http.Error(w, "File not found", http.StatusNotFound)
-		return
+	var done []*TrashEntry
+	failed := make(map[string]string)
+	remaining := make([]*TrashEntry, 0, len(manifest.Entries))
+	for _, entry := range manifest.Entries {
+		if !(req.All && purge) && !selected[entry.ID] {
+			remaining = append(remaining, entry)
+			continue
+		}
+		delete(selected, entry.ID)
+
+		if purge {
+			err = os.RemoveAll(filepath.Join(root, trashDirName, entry.ID))
+		} else {
+			err = restoreFromTrashLocked(root, entry)
+		}
+		if err != nil {
+			failed[entry.ID] = err.Error()
+			remaining = append(remaining, entry)
+			continue
+		}
+		done = append(done, entry)
+	}
+	for id := range selected {
+		failed[id] = "回收站中不存在该记录"
 	}
 
-	// 生成预览图文件名
-	thumbnailName := strings.TrimSuffix(decodedFilename, filepath.Ext(decodedFilename)) + "_thumbnail.jpg"
-	thumbnailPath := filepath.Join(cwd, "thumbnails", thumbnailName)
+	manifest.Entries = remaining
+	if err := saveTrashManifestLocked(root, manifest); err != nil {
+		return done, failed, err
+	}
+	return done, failed, nil
+}
 
-	// 创建thumbnails目录
-	thumbnailDir := filepath.Join(cwd, "thumbnails")
-	if err := os.MkdirAll(thumbnailDir, 0755); err != nil {
-		http.Error(w, "Failed to create thumbnail directory", http.StatusInternalServerError)
+// 永久删除回收站中超过保留天数的记录
+func purgeExpiredTrash() {
+	retention := getSettings().TrashRetentionDays
+	if retention <= 0 {
 		return
 	}
+	root := getLibraryRoot()
+	cutoff := time.Now().AddDate(0, 0, -retention)
 
-	// 检查预览图是否已存在
-	if _, err := os.Stat(thumbnailPath); err == nil {
-		// 预览图已存在，直接返回
-		http.ServeFile(w, r, thumbnailPath)
+	trashMu.Lock()
+	manifest, err := loadTrashManifestLocked(root)
+	trashMu.Unlock()
+	if err != nil {
+		log.Printf("读取回收站清单失败: %v", err)
 		return
 	}
 
-	// 使用FFmpeg生成预览图，保持宽高比
-	ffmpegPath := getExecutablePath("ffmpeg")
-	cmd := exec.Command(ffmpegPath, "-i", filePath, "-ss", "00:00:05", "-vframes", "1", "-vf", "scale='min(320,iw)':-1", "-y", thumbnailPath)
-
-	if err := cmd.Run(); err != nil {
-		log.Printf("FFmpeg error: %v", err)
-		http.Error(w, "Failed to generate thumbnail", http.StatusInternalServerError)
+	var req TrashRequest
+	for _, entry := range manifest.Entries {
+		if entry.DeletedAt.Before(cutoff) {
+			req.IDs = append(req.IDs, entry.ID)
+		}
+	}
+	if len(req.IDs) == 0 {
 		return
 	}
+	purged, _, err := processTrashEntries(root, req, true)
+	if err != nil {
+		log.Printf("清理回收站失败: %v", err)
+	}
+	log.Printf("已永久删除回收站中超过 %d 天的 %d 个文件", retention, len(purged))
+}
 
-	// 返回生成的预览图
-	http.ServeFile(w, r, thumbnailPath)
+// 定期清理回收站中过期的记录
+func runTrashPurger() {
+	for {
+		purgeExpiredTrash()
+		time.Sleep(time.Hour)
+	}
 }
 
-// 处理文件删除API请求
-func handleDelete(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
+// 处理回收站列表请求
+func handleTrashList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var req struct {
-		Filename string `json:"filename"`
+	trashMu.Lock()
+	manifest, err := loadTrashManifestLocked(getLibraryRoot())
+	trashMu.Unlock()
+	if err != nil {
+		http.Error(w, "Failed to read trash manifest", http.StatusInternalServerError)
+		return
+	}
+
+	// 最近删除的在前
+	sort.SliceStable(manifest.Entries, func(i, j int) bool {
+		return manifest.Entries[i].DeletedAt.After(manifest.Entries[j].DeletedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries":       manifest.Entries,
+		"retentionDays": getSettings().TrashRetentionDays,
+	})
+}
+
+// 处理回收站恢复和永久删除请求
+func handleTrashAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
+	purge := r.URL.Path == "/api/trash/purge"
 
+	var req TrashRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
-
-	if req.Filename == "" {
-		http.Error(w, "Filename not provided", http.StatusBadRequest)
+	if len(req.IDs) == 0 && !(req.All && purge) {
+		http.Error(w, "No ids provided", http.StatusBadRequest)
 		return
 	}
 
-	// 获取基础文件名，防止路径遍历攻击
-	filename := filepath.Base(req.Filename)
-
-	// 获取当前工作目录
-	cwd, err := os.Getwd()
-	if err != nil {
-		http.Error(w, "Failed to get working directory", http.StatusInternalServerError)
+	done, failed, err := processTrashEntries(getLibraryRoot(), req, purge)
+	if err != nil && done == nil {
+		http.Error(w, "Failed to update trash", http.StatusInternalServerError)
 		return
 	}
 
-	// 构建完整文件路径
-	filePath := filepath.Join(cwd, filename)
+	ids := make([]string, 0, len(done))
+	for _, entry := range done {
+		ids = append(ids, entry.ID)
+		if !purge {
+			publishLibraryEvent(LibraryEvent{Action: "added", Name: entry.Name})
+		}
+	}
 
-	// 检查文件是否存在
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		http.Error(w, "File not found", http.StatusNotFound)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"processed": ids,
+		"failed":    failed,
+	})
+}
+
+// 视频播放记录：相对路径 -> 最近播放时间（用于存储清理时优先清理没有看过的视频）
+var (
+	watchHistory      = make(map[string]time.Time)
+	watchHistoryMu    sync.Mutex
+	watchHistorySaved time.Time // 上次保存播放记录的时间（由watchHistoryMu保护）
+)
+
+// 启动时加载播放记录
+func loadWatchHistory() {
+	data, err := os.ReadFile(watchHistoryFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取播放记录失败: %v", err)
+		}
 		return
 	}
+	watchHistoryMu.Lock()
+	defer watchHistoryMu.Unlock()
+	if err := json.Unmarshal(data, &watchHistory); err != nil {
+		log.Printf("解析播放记录失败: %v", err)
+		watchHistory = make(map[string]time.Time)
+	}
+}
 
-	// 删除文件
-	if err := os.Remove(filePath); err != nil {
-		http.Error(w, "Failed to delete file", http.StatusInternalServerError)
+// 保存播放记录，调用方需持有watchHistoryMu
+func saveWatchHistoryLocked() {
+	data, err := json.Marshal(watchHistory)
+	if err != nil {
 		return
 	}
-
-	// 同时删除对应的预览图
-	thumbnailName := strings.TrimSuffix(filename, filepath.Ext(filename)) + "_thumbnail.jpg"
-	thumbnailPath := filepath.Join(cwd, "thumbnails", thumbnailName)
-	if _, err := os.Stat(thumbnailPath); err == nil {
-		os.Remove(thumbnailPath)
+	tmpFile := watchHistoryFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		log.Printf("保存播放记录失败: %v", err)
+		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+	os.Rename(tmpFile, watchHistoryFile)
+	watchHistorySaved = time.Now()
 }
 
-// 处理文件重命名API请求
-func handleRename(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// 记录一次播放（播放器的分段请求很频繁，最多每分钟保存一次）
+func recordWatched(rel string) {
+	watchHistoryMu.Lock()
+	defer watchHistoryMu.Unlock()
+	watchHistory[rel] = time.Now()
+	if time.Since(watchHistorySaved) > time.Minute {
+		saveWatchHistoryLocked()
 	}
+}
 
-	var req struct {
-		OldFilename string `json:"oldFilename"`
-		NewFilename string `json:"newFilename"`
+// 重命名视频时同步更新播放记录
+func renameWatchHistory(oldRel, newRel string) {
+	watchHistoryMu.Lock()
+	defer watchHistoryMu.Unlock()
+	if watched, ok := watchHistory[oldRel]; ok {
+		delete(watchHistory, oldRel)
+		watchHistory[newRel] = watched
+		saveWatchHistoryLocked()
 	}
+}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+// 获取磁盘剩余空间（字节）
+func diskFreeSpace(dir string) (int64, error) {
+	var output []byte
+	var err error
+	if isWindows() {
+		volume := filepath.VolumeName(dir)
+		output, err = exec.Command("powershell", "-NoProfile", "-Command", fmt.Sprintf("([System.IO.DriveInfo]'%s').AvailableFreeSpace", volume)).Output()
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
 	}
 
-	if req.OldFilename == "" || req.NewFilename == "" {
-		http.Error(w, "Filenames not provided", http.StatusBadRequest)
-		return
+	// df -P 输出的第二行第四列为可用的1K块数量
+	output, err = exec.Command("df", "-Pk", dir).Output()
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) < 2 {
+		return 0, fmt.Errorf("无法解析df输出")
+	}
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 4 {
+		return 0, fmt.Errorf("无法解析df输出")
+	}
+	available, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, err
 	}
+	return available * 1024, nil
+}
 
-	// 获取基础文件名，防止路径遍历攻击
-	oldFilename := filepath.Base(req.OldFilename)
-	newFilename := filepath.Base(req.NewFilename)
+// GB转换为字节
+func gigabytes(value float64) int64 {
+	return int64(value * (1 << 30))
+}
 
-	// 获取原文件的扩展名
-	oldExt := filepath.Ext(oldFilename)
-	
-	// 如果新文件名没有扩展名，则使用原文件的扩展名
-	if filepath.Ext(newFilename) == "" {
-		newFilename += oldExt
-	}
+// 计算视频库中媒体文件的总大小（不含回收站、缩略图、来源信息以及程序和设置等其他文件）
+func librarySize(root string) int64 {
+	var total int64
+	walkLibrary(root, "", func(rel string, entry fs.DirEntry) error {
+		if entry.IsDir() || mediaKindOf(entry.Name()) == "" {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
 
-	// 获取当前工作目录
-	cwd, err := os.Getwd()
-	if err != nil {
-		http.Error(w, "Failed to get working directory", http.StatusInternalServerError)
-		return
+// 加入下载队列前检查存储限制，超出时返回原因
+func checkStorageQuota() error {
+	currentSettings := getSettings()
+	root := getLibraryRoot()
+	if currentSettings.MinFreeDiskGB > 0 {
+		if free, err := diskFreeSpace(root); err == nil && free < gigabytes(currentSettings.MinFreeDiskGB) {
+			return fmt.Errorf("磁盘剩余空间不足：剩余 %.2f GB，至少需要保留 %.2f GB", float64(free)/(1<<30), currentSettings.MinFreeDiskGB)
+		}
+	}
+	if currentSettings.MaxLibrarySizeGB > 0 {
+		if size := librarySize(root); size >= gigabytes(currentSettings.MaxLibrarySizeGB) {
+			return fmt.Errorf("视频库已达到容量上限：已使用 %.2f GB，上限 %.2f GB", float64(size)/(1<<30), currentSettings.MaxLibrarySizeGB)
+		}
 	}
+	return nil
+}
 
-	// 构建完整文件路径
-	oldPath := filepath.Join(cwd, oldFilename)
-	newPath := filepath.Join(cwd, newFilename)
+// 存储清理的处理方式
+const (
+	RetentionTrash   = "trash"   // 移到回收站（默认）
+	RetentionDelete  = "delete"  // 永久删除
+	RetentionArchive = "archive" // 移动到归档目录
+)
 
-	// 检查原文件是否存在
-	if _, err := os.Stat(oldPath); os.IsNotExist(err) {
-		http.Error(w, "File not found", http.StatusNotFound)
-		return
+// 存储清理计划中的一个文件
+type RetentionItem struct {
+	Name        string     `json:"name"`
+	Size        int64      `json:"size"`
+	ModTime     time.Time  `json:"modTime"`
+	LastWatched *time.Time `json:"lastWatched,omitempty"`
+	Reason      string     `json:"reason"` // "age"（超过目录保留天数）、"size"（超过容量上限）、"disk"（磁盘剩余空间不足）
+	Action      string     `json:"action"` // 实际的处理方式，因磁盘空间不足清理的文件不会移到回收站
+	Done        bool       `json:"done"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// 存储清理报告
+type RetentionReport struct {
+	GeneratedAt     time.Time       `json:"generatedAt"`
+	DryRun          bool            `json:"dryRun"`
+	Action          string          `json:"action"`
+	Order           string          `json:"order"`
+	LibrarySize     int64           `json:"librarySize"`
+	MaxLibrarySize  int64           `json:"maxLibrarySize"`
+	FreeDisk        int64           `json:"freeDisk"` // -1表示无法获取
+	MinFreeDisk     int64           `json:"minFreeDisk"`
+	TrashPurged     []string        `json:"trashPurged"` // 为释放磁盘空间而永久删除的回收站记录
+	Items           []RetentionItem `json:"items"`
+	FreedBytes      int64           `json:"freedBytes"`                // 从视频库中移除的大小
+	FreedDiskBytes  int64           `json:"freedDiskBytes"`            // 实际释放的磁盘空间（移到回收站的文件仍占用磁盘，不计算在内）
+	DiskUnreachable bool            `json:"diskUnreachable,omitempty"` // 清空视频库和回收站也达不到剩余空间要求，没有为此清理文件
+}
+
+// 获取文件适用的目录保留天数（匹配最长的目录前缀，""表示整个视频库），0表示不限制
+func folderMaxAge(rel string, rules map[string]int) int {
+	days, matched := 0, -1
+	for folder, maxAge := range rules {
+		folder = strings.Trim(folder, "/")
+		if folder != "" && !strings.HasPrefix(rel, folder+"/") {
+			continue
+		}
+		if len(folder) > matched {
+			days, matched = maxAge, len(folder)
+		}
 	}
+	return days
+}
 
-	// 检查新文件名是否已存在
-	if _, err := os.Stat(newPath); err == nil {
-		http.Error(w, "File with new name already exists", http.StatusConflict)
-		return
+// 生成存储清理计划，dryRun为false时同时执行
+func runRetention(dryRun bool) RetentionReport {
+	currentSettings := getSettings()
+	root := getLibraryRoot()
+	report := RetentionReport{
+		GeneratedAt:    time.Now(),
+		DryRun:         dryRun,
+		Action:         currentSettings.RetentionAction,
+		Order:          currentSettings.RetentionOrder,
+		MaxLibrarySize: gigabytes(currentSettings.MaxLibrarySizeGB),
+		MinFreeDisk:    gigabytes(currentSettings.MinFreeDiskGB),
+		FreeDisk:       -1,
+		TrashPurged:    []string{},
+		Items:          []RetentionItem{},
+	}
+	if free, err := diskFreeSpace(root); err == nil {
+		report.FreeDisk = free
+	}
+
+	// 收集视频库中的视频和音频
+	watchHistoryMu.Lock()
+	history := make(map[string]time.Time, len(watchHistory))
+	for rel, watched := range watchHistory {
+		history[rel] = watched
+	}
+	watchHistoryMu.Unlock()
+
+	var files []RetentionItem
+	walkLibrary(root, "", func(rel string, entry fs.DirEntry) error {
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		kind := mediaKindOf(entry.Name())
+		if kind != "" {
+			report.LibrarySize += info.Size()
+		}
+		if kind != MediaKindVideo && kind != MediaKindAudio {
+			return nil
+		}
+		item := RetentionItem{Name: rel, Size: info.Size(), ModTime: info.ModTime()}
+		if watched, ok := history[rel]; ok {
+			item.LastWatched = &watched
+		}
+		files = append(files, item)
+		return nil
+	})
+
+	// 清理顺序：oldest按修改时间从旧到新；unwatched先清理没有看过的视频，再按最近播放时间从早到晚
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if currentSettings.RetentionOrder == "unwatched" {
+			if (a.LastWatched == nil) != (b.LastWatched == nil) {
+				return a.LastWatched == nil
+			}
+			if a.LastWatched != nil && !a.LastWatched.Equal(*b.LastWatched) {
+				return a.LastWatched.Before(*b.LastWatched)
+			}
+		}
+		return a.ModTime.Before(b.ModTime)
+	})
+
+	// 移到回收站的文件仍在同一磁盘上，只减少视频库大小，不释放磁盘空间
+	selected := make(map[string]bool)
+	var freed, diskFreed int64
+	selectItem := func(item RetentionItem, reason, action string) {
+		item.Reason = reason
+		item.Action = action
+		selected[item.Name] = true
+		freed += item.Size
+		if action != RetentionTrash {
+			diskFreed += item.Size
+		}
+		report.Items = append(report.Items, item)
 	}
 
-	// 重命名文件
-	if err := os.Rename(oldPath, newPath); err != nil {
-		http.Error(w, "Failed to rename file", http.StatusInternalServerError)
-		return
+	// 超过目录保留天数的文件
+	if len(currentSettings.FolderMaxAgeDays) > 0 {
+		for _, item := range files {
+			if days := folderMaxAge(item.Name, currentSettings.FolderMaxAgeDays); days > 0 && item.ModTime.Before(report.GeneratedAt.AddDate(0, 0, -days)) {
+				selectItem(item, "age", currentSettings.RetentionAction)
+			}
+		}
 	}
 
-	// 同时重命名对应的预览图
-	oldThumbnailName := strings.TrimSuffix(oldFilename, filepath.Ext(oldFilename)) + "_thumbnail.jpg"
-	newThumbnailName := strings.TrimSuffix(newFilename, filepath.Ext(newFilename)) + "_thumbnail.jpg"
-	oldThumbnailPath := filepath.Join(cwd, "thumbnails", oldThumbnailName)
-	newThumbnailPath := filepath.Join(cwd, "thumbnails", newThumbnailName)
-	if _, err := os.Stat(oldThumbnailPath); err == nil {
-		os.Rename(oldThumbnailPath, newThumbnailPath)
+	// 超过视频库容量上限时按顺序清理
+	if report.MaxLibrarySize > 0 {
+		for _, item := range files {
+			if report.LibrarySize-freed <= report.MaxLibrarySize {
+				break
+			}
+			if !selected[item.Name] {
+				selectItem(item, "size", currentSettings.RetentionAction)
+			}
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "newName": newFilename})
-}
+	// 开启purgeForFreeSpace后，磁盘剩余空间不足时先永久删除回收站中最早的记录，仍不足时再按顺序清理；
+	// 这些文件移到回收站不能释放空间，因此处理方式为trash时直接永久删除
+	if currentSettings.PurgeForFreeSpace && report.MinFreeDisk > 0 && report.FreeDisk >= 0 && report.FreeDisk+diskFreed < report.MinFreeDisk {
+		trashMu.Lock()
+		manifest, err := loadTrashManifestLocked(root)
+		trashMu.Unlock()
+		if err != nil {
+			manifest = &TrashManifest{}
+		}
 
-// 处理批量删除API请求
-func handleBatchDelete(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		// 最多能释放的空间：回收站中的记录加上还没有选中的文件
+		reclaimable := diskFreed
+		for _, entry := range manifest.Entries {
+			reclaimable += entry.Size
+		}
+		for _, item := range files {
+			if !selected[item.Name] {
+				reclaimable += item.Size
+			}
+		}
+
+		if report.FreeDisk+reclaimable < report.MinFreeDisk {
+			// 空间被视频库以外的文件占用，清空视频库也达不到要求，此时不为剩余空间清理任何文件
+			report.DiskUnreachable = true
+			log.Printf("存储清理：视频库和回收站最多能释放 %.2f GB，仍达不到 %.2f GB 的剩余空间要求，跳过按剩余空间清理",
+				float64(reclaimable)/(1<<30), float64(report.MinFreeDisk)/(1<<30))
+		} else {
+			sort.SliceStable(manifest.Entries, func(i, j int) bool {
+				return manifest.Entries[i].DeletedAt.Before(manifest.Entries[j].DeletedAt)
+			})
+			var purge TrashRequest
+			for _, entry := range manifest.Entries {
+				if report.FreeDisk+diskFreed >= report.MinFreeDisk {
+					break
+				}
+				purge.IDs = append(purge.IDs, entry.ID)
+				report.TrashPurged = append(report.TrashPurged, entry.Name)
+				diskFreed += entry.Size
+			}
+			if !dryRun && len(purge.IDs) > 0 {
+				processTrashEntries(root, purge, true)
+			}
+
+			diskAction := currentSettings.RetentionAction
+			if diskAction == RetentionTrash {
+				diskAction = RetentionDelete
+			}
+			for _, item := range files {
+				if report.FreeDisk+diskFreed >= report.MinFreeDisk {
+					break
+				}
+				if !selected[item.Name] {
+					selectItem(item, "disk", diskAction)
+				}
+			}
+		}
 	}
 
-	var req struct {
-		Filenames []string `json:"filenames"`
+	if !dryRun {
+		for i := range report.Items {
+			item := &report.Items[i]
+			if err := applyRetentionAction(root, item.Name, item.Action, currentSettings.ArchiveDir); err != nil {
+				item.Error = err.Error()
+				continue
+			}
+			item.Done = true
+			publishLibraryEvent(LibraryEvent{Action: "removed", Name: item.Name})
+		}
 	}
+	report.FreedBytes = freed
+	report.FreedDiskBytes = diskFreed
+	return report
+}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+// 按指定的处理方式清理一个文件
+func applyRetentionAction(root, rel, action, archiveDir string) error {
+	filePath := filepath.Join(root, filepath.FromSlash(rel))
+	switch action {
+	case RetentionDelete:
+		if err := os.Remove(filePath); err != nil {
+			return err
+		}
+		os.Remove(thumbnailPathFor(root, rel))
+		removeThumbnailVariants(root, rel)
+		os.Remove(metadataPathFor(root, rel))
+		return nil
+	case RetentionArchive:
+		archiveDir, err := filepath.Abs(archiveDir)
+		if err != nil {
+			return err
+		}
+		if err := moveFile(filePath, filepath.Join(archiveDir, filepath.FromSlash(rel))); err != nil {
+			return err
+		}
+		os.Remove(thumbnailPathFor(root, rel))
+		removeThumbnailVariants(root, rel)
+		moveFile(metadataPathFor(root, rel), metadataPathFor(archiveDir, rel))
+		return nil
+	default:
+		_, err := moveToTrash(root, rel)
+		return err
 	}
+}
 
-	if len(req.Filenames) == 0 {
-		http.Error(w, "No filenames provided", http.StatusBadRequest)
-		return
+// 移动文件，不在同一磁盘时复制后删除原文件
+func moveFile(src, dst string) error {
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
 	}
 
-	// 获取当前工作目录
-	cwd, err := os.Getwd()
+	in, err := os.Open(src)
 	if err != nil {
-		http.Error(w, "Failed to get working directory", http.StatusInternalServerError)
-		return
+		return err
 	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
 
-	var deletedFiles []string
-	var failedFiles []string
-
-	for _, filename := range req.Filenames {
-		// 获取基础文件名，防止路径遍历攻击
-		cleanFilename := filepath.Base(filename)
-		filePath := filepath.Join(cwd, cleanFilename)
+// 定期按存储限制清理视频库
+func runStorageJanitor() {
+	for {
+		currentSettings := getSettings()
+		interval := currentSettings.JanitorInterval
+		if interval <= 0 {
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(time.Duration(interval) * time.Minute)
 
-		// 检查文件是否存在并删除
-		if _, err := os.Stat(filePath); err == nil {
-			if err := os.Remove(filePath); err == nil {
-				deletedFiles = append(deletedFiles, cleanFilename)
+		watchHistoryMu.Lock()
+		saveWatchHistoryLocked()
+		watchHistoryMu.Unlock()
 
-				// 同时删除对应的预览图
-				thumbnailName := strings.TrimSuffix(cleanFilename, filepath.Ext(cleanFilename)) + "_thumbnail.jpg"
-				thumbnailPath := filepath.Join(cwd, "thumbnails", thumbnailName)
-				if _, err := os.Stat(thumbnailPath); err == nil {
-					os.Remove(thumbnailPath)
-				}
-			} else {
-				failedFiles = append(failedFiles, cleanFilename)
-			}
-		} else {
-			failedFiles = append(failedFiles, cleanFilename)
+		if currentSettings.MaxLibrarySizeGB <= 0 && (currentSettings.MinFreeDiskGB <= 0 || !currentSettings.PurgeForFreeSpace) && len(currentSettings.FolderMaxAgeDays) == 0 {
+			continue
+		}
+		report := runRetention(false)
+		if len(report.Items) > 0 || len(report.TrashPurged) > 0 {
+			log.Printf("存储清理：处理了 %d 个文件，永久删除了 %d 个回收站记录", len(report.Items), len(report.TrashPurged))
 		}
 	}
+}
+
+// 处理存储清理请求：GET 返回清理计划（不执行），POST 立即执行清理
+func handleRetention(w http.ResponseWriter, r *http.Request) {
+	var report RetentionReport
+	switch r.Method {
+	case "GET":
+		report = runRetention(true)
+	case "POST":
+		report = runRetention(false)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success":      true,
-		"deleted":      deletedFiles,
-		"failed":       failedFiles,
-		"deletedCount": len(deletedFiles),
-		"failedCount":  len(failedFiles),
-	})
+	json.NewEncoder(w).Encode(report)
 }
 
 // 处理停止请求
@@ -1044,49 +5908,83 @@ func handleStop(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 查找并停止指定任务
-	tasksMu.Lock()
-	cmd, exists := activeTasks[req.TaskID]
-	if !exists {
-		tasksMu.Unlock()
+	jobsMu.Lock()
+	job := findJobLocked(req.TaskID)
+	if job == nil || isJobTerminal(job.Status) {
+		jobsMu.Unlock()
 		http.Error(w, "指定的任务不存在或已完成", http.StatusBadRequest)
 		return
 	}
-	tasksMu.Unlock()
+
+	// 排队中或等待重试的任务直接标记为已停止
+	if job.Status == JobQueued || job.Status == JobRetrying {
+		now := time.Now()
+		job.Status = JobStopped
+		job.FinishedAt = &now
+		saveQueueLocked()
+		jobsMu.Unlock()
+
+		sendTaskStatus(req.TaskID, JobStopped)
+		sendMessageToTask(req.TaskID, fmt.Sprintf("[%s] 用户取消了排队中的任务", time.Now().Format("2006-01-02 15:04:05")), "log")
+		sendMessageToTask(req.TaskID, "COMMAND_FINISHED", "complete")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("任务已停止"))
+		return
+	}
 
 	// 获取任务对应的文件名和视频格式（用于删除未完成的文件）
-	filesMu.Lock()
-	filename := taskFiles[req.TaskID]
-	filesMu.Unlock()
+	filename := job.Filename
+	videoFormat := job.VideoFormat
+	jobDir := job.Dir
+
+	if job.Status == JobPaused {
+		// 已暂停的任务没有运行中的进程，直接标记为已停止并清理临时文件
+		now := time.Now()
+		job.Status = JobStopped
+		job.FinishedAt = &now
+		saveQueueLocked()
+		jobsMu.Unlock()
+
+		sendTaskStatus(req.TaskID, JobStopped)
+		sendMessageToTask(req.TaskID, fmt.Sprintf("[%s] 用户停止了已暂停的下载", time.Now().Format("2006-01-02 15:04:05")), "log")
+	} else {
+		cmd := job.cmd
+		if cmd == nil || cmd.Process == nil {
+			jobsMu.Unlock()
+			http.Error(w, "任务正在启动，请稍后再试", http.StatusConflict)
+			return
+		}
+		job.interrupt = JobStopped
+		jobsMu.Unlock()
+
+		// 终止进程
+		if err := cmd.Process.Kill(); err != nil {
+			jobsMu.Lock()
+			job.interrupt = ""
+			jobsMu.Unlock()
+			sendMessageToTask(req.TaskID, fmt.Sprintf("停止命令时出错：%v", err), "error")
+			http.Error(w, "停止命令失败", http.StatusInternalServerError)
+			return
+		}
 
-	formatsMu.Lock()
-	videoFormat := taskFormats[req.TaskID]
-	formatsMu.Unlock()
+		sendMessageToTask(req.TaskID, fmt.Sprintf("[%s] 用户手动停止了下载", time.Now().Format("2006-01-02 15:04:05")), "log")
+	}
 
 	// 如果没有找到视频格式，使用默认的mp4
 	if videoFormat == "" {
 		videoFormat = "mp4"
 	}
 
-	// 终止进程
-	if err := cmd.Process.Kill(); err != nil {
-		sendMessageToTask(req.TaskID, fmt.Sprintf("停止命令时出错：%v", err), "error")
-		http.Error(w, "停止命令失败", http.StatusInternalServerError)
-		return
-	}
-
-	sendMessageToTask(req.TaskID, fmt.Sprintf("[%s] 用户手动停止了下载", time.Now().Format("2006-01-02 15:04:05")), "log")
-
 	// 延迟2秒后再检测和删除文件，确保进程完全停止
 	sendMessageToTask(req.TaskID, "等待2秒后开始检测临时文件...", "log")
 	time.Sleep(2 * time.Second)
 
 	// 删除未完成的文件
 	if filename != "" {
-		// 获取当前工作目录的绝对路径
-		cwd, err := os.Getwd()
-		if err != nil {
-			sendMessageToTask(req.TaskID, fmt.Sprintf("[调试] 获取工作目录失败: %v", err), "log")
-			cwd = "."
+		// 相对路径以任务的下载目录为基准
+		cwd := jobDir
+		if cwd == "" {
+			cwd = getLibraryRoot()
 		}
 
 		// 如果filename是相对路径，转换为绝对路径
@@ -1164,23 +6062,125 @@ func handleStop(w http.ResponseWriter, r *http.Request) {
 		sendMessageToTask(req.TaskID, "[调试] 当前文件名为空，无法进行文件删除", "log")
 	}
 
-	// 清理任务相关数据
-	tasksMu.Lock()
-	delete(activeTasks, req.TaskID)
-	tasksMu.Unlock()
+	sendMessageToTask(req.TaskID, "COMMAND_FINISHED", "complete") // 发送完成信号
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("任务已停止"))
+}
+
+// 处理暂停请求（停止yt-dlp进程但保留临时文件和任务记录）
+func handlePause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 解析请求参数
+	var req PauseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "无效的JSON参数", http.StatusBadRequest)
+		return
+	}
+
+	if req.TaskID == "" {
+		http.Error(w, "任务ID不能为空", http.StatusBadRequest)
+		return
+	}
+
+	jobsMu.Lock()
+	job := findJobLocked(req.TaskID)
+	if job == nil || (job.Status != JobQueued && job.Status != JobRetrying && job.Status != JobRunning) {
+		jobsMu.Unlock()
+		http.Error(w, "指定的任务不存在或无法暂停", http.StatusBadRequest)
+		return
+	}
+
+	// 排队中或等待重试的任务直接标记为暂停，不会被调度
+	if job.Status == JobQueued || job.Status == JobRetrying {
+		job.Status = JobPaused
+		job.NextRetryAt = nil
+		saveQueueLocked()
+		jobsMu.Unlock()
+
+		sendTaskStatus(req.TaskID, JobPaused)
+		sendMessageToTask(req.TaskID, fmt.Sprintf("[%s] 任务已暂停", time.Now().Format("2006-01-02 15:04:05")), "log")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("任务已暂停"))
+		return
+	}
+
+	cmd := job.cmd
+	if cmd == nil || cmd.Process == nil {
+		jobsMu.Unlock()
+		http.Error(w, "任务正在启动，请稍后再试", http.StatusConflict)
+		return
+	}
+	job.interrupt = JobPaused
+	jobsMu.Unlock()
+
+	// 终止进程，yt-dlp的.part临时文件会保留下来，恢复时从断点继续
+	if err := cmd.Process.Kill(); err != nil {
+		jobsMu.Lock()
+		job.interrupt = ""
+		jobsMu.Unlock()
+		sendMessageToTask(req.TaskID, fmt.Sprintf("暂停命令时出错：%v", err), "error")
+		http.Error(w, "暂停命令失败", http.StatusInternalServerError)
+		return
+	}
+
+	sendMessageToTask(req.TaskID, fmt.Sprintf("[%s] 用户暂停了下载，临时文件已保留", time.Now().Format("2006-01-02 15:04:05")), "log")
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("任务已暂停"))
+}
+
+// 处理恢复请求（使用相同的命令参数重新加入队列）
+func handleResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 解析请求参数
+	var req PauseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "无效的JSON参数", http.StatusBadRequest)
+		return
+	}
+
+	if req.TaskID == "" {
+		http.Error(w, "任务ID不能为空", http.StatusBadRequest)
+		return
+	}
+
+	jobsMu.Lock()
+	job := findJobLocked(req.TaskID)
+	if job != nil && job.Status == JobRunning && job.interrupt == JobPaused {
+		// 进程还没有完全退出，退出后直接重新排队
+		job.interrupt = JobQueued
+		jobsMu.Unlock()
 
-	filesMu.Lock()
-	delete(taskFiles, req.TaskID)
-	filesMu.Unlock()
+		sendMessageToTask(req.TaskID, fmt.Sprintf("[%s] 任务将在暂停完成后恢复", time.Now().Format("2006-01-02 15:04:05")), "log")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("任务已恢复"))
+		return
+	}
+	if job == nil || job.Status != JobPaused {
+		jobsMu.Unlock()
+		http.Error(w, "指定的任务不存在或未暂停", http.StatusBadRequest)
+		return
+	}
+	job.Status = JobQueued
+	saveQueueLocked()
+	jobsMu.Unlock()
 
-	formatsMu.Lock()
-	delete(taskFormats, req.TaskID)
-	formatsMu.Unlock()
+	sendTaskStatus(req.TaskID, JobQueued)
+	sendMessageToTask(req.TaskID, fmt.Sprintf("[%s] 任务已恢复，重新加入下载队列", time.Now().Format("2006-01-02 15:04:05")), "log")
 
-	sendMessageToTask(req.TaskID, "COMMAND_FINISHED", "complete") // 发送完成信号
+	scheduleJobs()
 
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("任务已停止"))
+	w.Write([]byte("任务已恢复"))
 }
 
 // 处理配置保存请求
@@ -1265,6 +6265,422 @@ func handleConfigLoad(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(config)
 }
 
+// 默认服务端设置
+func defaultSettings() Settings {
+	return Settings{
+		MaxConcurrentDownloads: 3,
+		Retry: RetryPolicy{
+			MaxAttempts: 3,
+			BaseDelay:   10,
+			MaxDelay:    300,
+		},
+		LibraryRoot:          ".",
+		LibraryMaxDepth:      5,
+		TrashRetentionDays:   30,
+		LibraryWatchInterval: 5,
+		DuplicatePolicy:      DuplicateKeep,
+		RetentionAction:      RetentionTrash,
+		RetentionOrder:       "oldest",
+		JanitorInterval:      60,
+	}
+}
+
+// 获取当前服务端设置的副本
+func getSettings() Settings {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	return settings
+}
+
+// 修正不合法的设置值
+func normalizeSettings(s Settings) Settings {
+	defaults := defaultSettings()
+	if s.MaxConcurrentDownloads <= 0 {
+		s.MaxConcurrentDownloads = defaults.MaxConcurrentDownloads
+	}
+	s.Retry = normalizeRetryPolicy(s.Retry, defaults.Retry)
+	if strings.TrimSpace(s.LibraryRoot) == "" {
+		s.LibraryRoot = defaults.LibraryRoot
+	}
+	s.TempDir = strings.TrimSpace(s.TempDir)
+	if s.LibraryMaxDepth < 0 {
+		s.LibraryMaxDepth = 0
+	}
+	switch s.DuplicatePolicy {
+	case DuplicateSkip, DuplicateOverwrite, DuplicateKeep:
+	default:
+		s.DuplicatePolicy = defaults.DuplicatePolicy
+	}
+	switch s.RetentionAction {
+	case RetentionTrash, RetentionDelete:
+	case RetentionArchive:
+		// 没有设置归档目录时不能归档
+		if strings.TrimSpace(s.ArchiveDir) == "" {
+			s.RetentionAction = RetentionTrash
+		}
+	default:
+		s.RetentionAction = defaults.RetentionAction
+	}
+	if s.RetentionOrder != "oldest" && s.RetentionOrder != "unwatched" {
+		s.RetentionOrder = defaults.RetentionOrder
+	}
+	if s.MaxLibrarySizeGB < 0 {
+		s.MaxLibrarySizeGB = 0
+	}
+	if s.MinFreeDiskGB < 0 {
+		s.MinFreeDiskGB = 0
+	}
+	if s.JanitorInterval < 0 {
+		s.JanitorInterval = 0
+	}
+	if s.LibraryWatchInterval < 0 {
+		s.LibraryWatchInterval = 0
+	}
+	if s.TrashRetentionDays < 0 {
+		s.TrashRetentionDays = 0
+	}
+	return s
+}
+
+// 检查输出模板，保证下载的文件不会写到视频库根目录之外
+func validateOutputTemplate(template string) error {
+	if template == "" {
+		return nil
+	}
+	if filepath.IsAbs(template) || strings.HasPrefix(template, "/") || strings.HasPrefix(template, "\\") {
+		return fmt.Errorf("输出模板必须是相对视频库根目录的路径")
+	}
+	for _, part := range strings.FieldsFunc(template, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return fmt.Errorf("输出模板不能包含..")
+		}
+	}
+	return nil
+}
+
+// 获取视频库根目录的绝对路径
+func getLibraryRoot() string {
+	root := getSettings().LibraryRoot
+	if absRoot, err := filepath.Abs(root); err == nil {
+		return absRoot
+	}
+	return root
+}
+
+// 获取临时文件目录的绝对路径，未设置时返回空字符串
+func getTempDir() string {
+	tempDir := getSettings().TempDir
+	if tempDir == "" {
+		return ""
+	}
+	if absDir, err := filepath.Abs(tempDir); err == nil {
+		return absDir
+	}
+	return tempDir
+}
+
+// 从命令参数中获取 -P temp: 指定的临时目录
+func argsTempDir(args []string) string {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "-P" && strings.HasPrefix(args[i+1], "temp:") {
+			return strings.TrimPrefix(args[i+1], "temp:")
+		}
+	}
+	return ""
+}
+
+// 将yt-dlp输出的文件路径转换为相对视频库根目录的路径（临时目录中的文件完成后会移动到视频库中相同的相对位置）
+func libraryRelativePath(filename, root, tempDir string) string {
+	if !filepath.IsAbs(filename) {
+		return filepath.Clean(filename)
+	}
+	for _, dir := range []string{root, tempDir} {
+		if dir == "" {
+			continue
+		}
+		if rel, err := filepath.Rel(dir, filename); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return rel
+		}
+	}
+	return filename
+}
+
+// 修正不合法的重试策略，缺省值取自defaults
+func normalizeRetryPolicy(p, defaults RetryPolicy) RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaults.MaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = defaults.BaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaults.MaxDelay
+	}
+	if p.MaxDelay < p.BaseDelay {
+		p.MaxDelay = p.BaseDelay
+	}
+	return p
+}
+
+// 启动时从文件加载服务端设置
+func loadSettings() {
+	data, err := os.ReadFile(settingsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取服务端设置失败: %v", err)
+		}
+		return
+	}
+
+	loaded := defaultSettings()
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		log.Printf("解析服务端设置失败: %v", err)
+		return
+	}
+	// 手动编辑的设置文件同样不允许输出到视频库之外
+	if err := validateOutputTemplate(loaded.OutputTemplate); err != nil {
+		log.Printf("忽略无效的输出模板 %q: %v", loaded.OutputTemplate, err)
+		loaded.OutputTemplate = ""
+	}
+
+	settingsMu.Lock()
+	settings = normalizeSettings(loaded)
+	settingsMu.Unlock()
+}
+
+// 处理服务端设置保存请求
+func handleSettingsSave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 未提供的字段保留当前值
+	newSettings := getSettings()
+	if err := json.NewDecoder(r.Body).Decode(&newSettings); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	newSettings = normalizeSettings(newSettings)
+	if err := validateOutputTemplate(newSettings.OutputTemplate); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	settingsData, err := json.MarshalIndent(newSettings, "", "  ")
+	if err != nil {
+		http.Error(w, "Failed to marshal settings", http.StatusInternalServerError)
+		return
+	}
+
+	if err := os.WriteFile(settingsFile, settingsData, 0644); err != nil {
+		http.Error(w, "Failed to save settings", http.StatusInternalServerError)
+		return
+	}
+
+	settingsMu.Lock()
+	settings = newSettings
+	settingsMu.Unlock()
+
+	// 并发数量可能已调大，重新调度队列
+	scheduleJobs()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "设置保存成功"})
+}
+
+// 处理服务端设置加载请求
+func handleSettingsLoad(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(getSettings())
+}
+
+// 平台规则：按主机名或正则匹配网址，并提供该平台使用的下载参数
+type PlatformRule struct {
+	Name      string        `json:"name"`      // 规则名称，对应前端的platform参数
+	Label     string        `json:"label"`     // 显示名称
+	Hosts     []string      `json:"hosts"`     // 匹配的主机名（包含子域名）
+	Pattern   string        `json:"pattern"`   // 匹配网址的正则表达式
+	Format    string        `json:"format"`    // -f 格式选择器
+	Sort      string        `json:"sort"`      // -S 排序字符串
+	Merge     bool          `json:"merge"`     // 是否按所选视频格式合并并转码
+	Referer   string        `json:"referer"`   // Referer策略: none（默认）、origin（网址的协议+主机名）、url（完整网址）或固定的网址
+	Cookies   *CookieSource `json:"cookies"`   // Cookie来源，前端未指定时使用
+	SubLangs  string        `json:"subLangs"`  // --sub-langs 字幕语言
+	Output    string        `json:"output"`    // -o 输出模板
+	ExtraArgs []string      `json:"extraArgs"` // 其他yt-dlp参数
+
+	patternRe *regexp.Regexp
+}
+
+// 规则中的Cookie来源（取值与Config中的Cookie字段相同）
+type CookieSource struct {
+	Mode    string `json:"mode"`
+	Browser string `json:"browser"`
+	Profile string `json:"profile"`
+	Site    string `json:"site"`
+}
+
+// 规则文件结构体
+type RulesFile struct {
+	Rules []*PlatformRule `json:"rules"`
+}
+
+// 内置规则，rules.json不存在时使用
+func defaultRules() []*PlatformRule {
+	return []*PlatformRule{
+		{Name: "youtube", Label: "YouTube", Hosts: []string{"youtube.com", "youtu.be"}, Format: "bv*+ba/b", Sort: "res:desc,br:desc", Merge: true},
+		{Name: "tiktok", Label: "TikTok", Hosts: []string{"tiktok.com"}, Format: "bv*+ba/b", Sort: "res:desc,br:desc", Merge: true},
+		{Name: "bilibili", Label: "Bilibili", Hosts: []string{"bilibili.com", "b23.tv"}, Format: "bv*+ba", Sort: "res:desc,br:desc", Merge: true, SubLangs: "all"},
+		{Name: "generic1", Label: "其他通用1（最高画质）", Format: "bv*+ba/b", Sort: "res:desc,br:desc", Merge: true, Referer: "origin"},
+		{Name: "generic2", Label: "其他通用2", Merge: true, Referer: "origin"},
+	}
+}
+
+// 检查并编译规则
+func compileRules(list []*PlatformRule) error {
+	names := make(map[string]bool)
+	for i, rule := range list {
+		if rule == nil || rule.Name == "" {
+			return fmt.Errorf("第%d条规则缺少名称", i+1)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("规则名称重复: %s", rule.Name)
+		}
+		names[rule.Name] = true
+		if rule.Pattern != "" {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return fmt.Errorf("规则 %s 的正则表达式无效: %v", rule.Name, err)
+			}
+			rule.patternRe = re
+		}
+		if err := validateOutputTemplate(rule.Output); err != nil {
+			return fmt.Errorf("规则 %s 的输出模板无效: %v", rule.Name, err)
+		}
+		for j, host := range rule.Hosts {
+			rule.Hosts[j] = strings.TrimPrefix(strings.ToLower(host), "www.")
+		}
+	}
+	return nil
+}
+
+// 获取当前规则，rules.json修改后会自动重新加载，文件无效时继续使用之前的规则
+func getRules() []*PlatformRule {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+
+	info, err := os.Stat(rulesFile)
+	if err != nil {
+		if rules == nil || !rulesModTime.IsZero() {
+			rules = defaultRules()
+			compileRules(rules)
+			rulesModTime = time.Time{}
+		}
+		return rules
+	}
+	if rules != nil && info.ModTime().Equal(rulesModTime) {
+		return rules
+	}
+
+	rulesModTime = info.ModTime()
+	data, err := os.ReadFile(rulesFile)
+	if err == nil {
+		var file RulesFile
+		if err = json.Unmarshal(data, &file); err == nil {
+			err = compileRules(file.Rules)
+		}
+		if err == nil {
+			rules = file.Rules
+			log.Printf("已加载 %d 条平台规则", len(rules))
+			return rules
+		}
+	}
+	log.Printf("加载规则文件失败: %v", err)
+	if rules == nil {
+		rules = defaultRules()
+		compileRules(rules)
+	}
+	return rules
+}
+
+// 按名称查找规则
+func findRule(list []*PlatformRule, name string) *PlatformRule {
+	for _, rule := range list {
+		if rule.Name == name {
+			return rule
+		}
+	}
+	return nil
+}
+
+// 根据网址自动识别平台：按顺序返回第一条匹配的规则，没有主机名和正则的规则匹配所有网址
+func detectRule(list []*PlatformRule, videoURL string) *PlatformRule {
+	host := ""
+	if parsedURL, err := url.Parse(videoURL); err == nil {
+		host = strings.TrimPrefix(strings.ToLower(parsedURL.Hostname()), "www.")
+	}
+
+	for _, rule := range list {
+		if len(rule.Hosts) == 0 && rule.patternRe == nil {
+			return rule
+		}
+		for _, h := range rule.Hosts {
+			if host != "" && (host == h || strings.HasSuffix(host, "."+h)) {
+				return rule
+			}
+		}
+		if rule.patternRe != nil && rule.patternRe.MatchString(videoURL) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// 前端未指定Cookie来源时使用规则中的设置
+func applyRuleCookies(config *Config, rule *PlatformRule) {
+	if config.CookieMode != "" || rule == nil || rule.Cookies == nil {
+		return
+	}
+	config.CookieMode = rule.Cookies.Mode
+	config.CookieBrowser = rule.Cookies.Browser
+	config.CookieProfile = rule.Cookies.Profile
+	config.CookieSite = rule.Cookies.Site
+}
+
+// 根据Referer策略获取Referer
+func ruleReferer(policy, videoURL string) string {
+	switch policy {
+	case "", "none":
+		return ""
+	case "origin":
+		return extractReferer(videoURL)
+	case "url":
+		return videoURL
+	default:
+		return policy
+	}
+}
+
+// 处理规则列表请求
+func handleRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(RulesFile{Rules: getRules()})
+}
+
 // 从URL中提取主域名作为referer
 func extractReferer(urlStr string) string {
 	parsedURL, err := url.Parse(urlStr)
@@ -1276,83 +6692,30 @@ func extractReferer(urlStr string) string {
 	return parsedURL.Scheme + "://" + parsedURL.Host
 }
 
-// 根据平台类型构建命令参数
-func buildCommandArgs(platform, url, videoFormat string) []string {
+// 根据平台规则构建命令参数
+func buildCommandArgs(rule *PlatformRule, url, videoFormat string) []string {
 	var args []string
 
 	// 确保视频格式为小写
 	videoFormat = strings.ToLower(videoFormat)
 
-	switch platform {
-	case "youtube":
-		// YouTube
-		args = []string{
-			"-f", "bv*+ba/b",
-			"-S", "res:desc,br:desc",
-			"--merge-output-format", videoFormat,
-			"--recode-video", videoFormat,
-			"--cookies-from-browser", "firefox",
-			"--newline", // 强制每行输出后换行
-			url,
-		}
-	case "tiktok":
-		// TikTok
-		args = []string{
-			"-f", "bv*+ba/b",
-			"-S", "res:desc,br:desc",
-			"--merge-output-format", videoFormat,
-			"--recode-video", videoFormat,
-			"--cookies-from-browser", "firefox",
-			"--newline", // 强制每行输出后换行
-			url,
-		}
-	case "bilibili":
-		// Bilibili
-		args = []string{
-			"-f", "bv*+ba",
-			"-S", "res:desc,br:desc",
-			"--merge-output-format", videoFormat,
-			"--recode-video", videoFormat,
-			"--cookies-from-browser", "firefox",
-			"--sub-langs", "all",
-			"--newline", // 强制每行输出后换行
-			url,
-		}
-	case "generic1":
-		// 其他通用1（最高画质）
-		referer := extractReferer(url)
-		args = []string{
-			"-f", "bv*+ba/b",
-			"-S", "res:desc,br:desc",
-			"--merge-output-format", videoFormat,
-			"--recode-video", videoFormat,
-			"--cookies-from-browser", "firefox",
-		}
-		if referer != "" {
-			args = append(args, "--referer", referer)
-		}
-		args = append(args, "--newline") // 强制每行输出后换行
-		args = append(args, url)         // 添加URL到最后
-	case "generic2":
-		// 其他通用2
-		referer := extractReferer(url)
-		args = []string{
-			"--merge-output-format", videoFormat,
-			"--recode-video", videoFormat,
-			"--cookies-from-browser", "firefox",
-		}
-		if referer != "" {
-			args = append(args, "--referer", referer)
-		}
-		args = append(args, "--newline") // 强制每行输出后换行
-		args = append(args, url)         // 添加URL到最后
-	default:
-		// 默认情况
-		args = []string{
-			"--newline", // 强制每行输出后换行
-			url,
-		}
+	if rule.Format != "" {
+		args = append(args, "-f", rule.Format)
+	}
+	if rule.Sort != "" {
+		args = append(args, "-S", rule.Sort)
 	}
+	if rule.Merge {
+		args = append(args, "--merge-output-format", videoFormat, "--recode-video", videoFormat)
+	}
+	if rule.SubLangs != "" {
+		args = append(args, "--sub-langs", rule.SubLangs)
+	}
+	if referer := ruleReferer(rule.Referer, url); referer != "" {
+		args = append(args, "--referer", referer)
+	}
+	args = append(args, "--newline") // 强制每行输出后换行
+	args = append(args, url)         // 添加URL到最后
 
 	return args
 }
@@ -1365,7 +6728,6 @@ func buildAdvancedCommandArgs(config Config, url, videoFormat string) []string {
 	videoFormat = strings.ToLower(videoFormat)
 
 	// 固定参数
-	args = append(args, "--cookies-from-browser", "firefox")
 	args = append(args, "--newline") // 强制每行输出后换行
 
 	// 下载设置参数（-f 参数需要放在最前面）
@@ -1469,6 +6831,162 @@ func buildAdvancedCommandArgs(config Config, url, videoFormat string) []string {
 	return args
 }
 
+// 格式选择参数的合法取值
+var (
+	formatIDRe      = regexp.MustCompile(`^[\w.\-]+(?:\+[\w.\-]+)*(?:/[\w.\-]+(?:\+[\w.\-]+)*)*$`)
+	videoCodecSorts = map[string]string{"av1": "vcodec:av01", "vp9": "vcodec:vp9", "h264": "vcodec:h264"}
+	audioCodecSorts = map[string]string{"opus": "acodec:opus", "aac": "acodec:aac"}
+	videoSelectors  = map[string]bool{"b": true, "b*": true, "best": true, "best*": true, "bv": true, "bv*": true, "bestvideo": true, "bestvideo*": true, "w": true, "w*": true, "worst": true, "worst*": true, "wv": true, "wv*": true, "worstvideo": true, "worstvideo*": true}
+)
+
+// 将格式选择转换为yt-dlp的-f过滤条件和-S排序字符串
+func buildFormatSelection(sel FormatSelection) (string, string, error) {
+	var filters string
+	var sorts []string
+
+	if sel.FormatID != "" && !formatIDRe.MatchString(sel.FormatID) {
+		return "", "", fmt.Errorf("无效的格式ID: %s", sel.FormatID)
+	}
+
+	if sel.VideoCodec != "" {
+		sortField, ok := videoCodecSorts[strings.ToLower(sel.VideoCodec)]
+		if !ok {
+			return "", "", fmt.Errorf("不支持的视频编码: %s", sel.VideoCodec)
+		}
+		sorts = append(sorts, sortField)
+	}
+
+	if sel.AudioCodec != "" {
+		sortField, ok := audioCodecSorts[strings.ToLower(sel.AudioCodec)]
+		if !ok {
+			return "", "", fmt.Errorf("不支持的音频编码: %s", sel.AudioCodec)
+		}
+		sorts = append(sorts, sortField)
+	}
+
+	if sel.MaxFPS < 0 {
+		return "", "", fmt.Errorf("无效的帧率限制: %d", sel.MaxFPS)
+	}
+	if sel.MaxFPS > 0 {
+		filters += fmt.Sprintf("[fps<=%d]", sel.MaxFPS)
+	}
+
+	switch sel.HDR {
+	case "":
+	case "prefer":
+		sorts = append(sorts, "hdr")
+	case "avoid":
+		sorts = append(sorts, "hdr:SDR")
+	case "only":
+		filters += "[dynamic_range!=SDR]"
+	case "exclude":
+		filters += "[dynamic_range=SDR]"
+	default:
+		return "", "", fmt.Errorf("无效的HDR选项: %s", sel.HDR)
+	}
+
+	return filters, strings.Join(sorts, ","), nil
+}
+
+// 为格式选择器中的视频部分追加过滤条件，例如 "bv*+ba/b" -> "bv*[fps<=30]+ba/b[fps<=30]"
+func addVideoFilters(spec, filters string) string {
+	alternatives := strings.Split(spec, "/")
+	for i, alternative := range alternatives {
+		parts := strings.Split(alternative, "+")
+		for j, part := range parts {
+			name := part
+			if idx := strings.Index(part, "["); idx != -1 {
+				name = part[:idx]
+			}
+			if videoSelectors[name] {
+				parts[j] = part + filters
+			}
+		}
+		alternatives[i] = strings.Join(parts, "+")
+	}
+	return strings.Join(alternatives, "/")
+}
+
+// 将请求中的格式选择应用到命令参数上：
+// 明确的格式ID替换原有的-f；帧率/HDR限制追加到原有-f的视频部分；编码偏好加在原有-S之前
+func applyFormatSelection(args []string, sel FormatSelection) ([]string, error) {
+	filters, sorts, err := buildFormatSelection(sel)
+	if err != nil {
+		return nil, err
+	}
+	if sel.FormatID == "" && filters == "" && sorts == "" {
+		return args, nil
+	}
+
+	// 取出原有的-f和-S参数
+	formatSpec, sortSpec := "", ""
+	result := make([]string, 0, len(args)+4)
+	for i := 0; i < len(args); i++ {
+		if i+1 < len(args)-1 {
+			switch args[i] {
+			case "-f":
+				formatSpec = args[i+1]
+				i++
+				continue
+			case "-S":
+				sortSpec = args[i+1]
+				i++
+				continue
+			}
+		}
+		result = append(result, args[i])
+	}
+
+	if sel.FormatID != "" {
+		formatSpec = sel.FormatID
+	} else if filters != "" {
+		if formatSpec == "" {
+			formatSpec = "bv*+ba/b"
+		}
+		formatSpec = addVideoFilters(formatSpec, filters)
+	}
+	if sorts != "" {
+		if sortSpec != "" {
+			sortSpec = sorts + "," + sortSpec
+		} else {
+			sortSpec = sorts
+		}
+	}
+
+	var prefix []string
+	if formatSpec != "" {
+		prefix = append(prefix, "-f", formatSpec)
+	}
+	if sortSpec != "" {
+		prefix = append(prefix, "-S", sortSpec)
+	}
+	return append(prefix, result...), nil
+}
+
+// 播放列表条目参数的格式，例如 "1,3,5-7"
+var playlistItemsRe = regexp.MustCompile(`^\d+(?:-\d*)?(?:,\d+(?:-\d*)?)*$`)
+
+// 检查命令参数中是否包含指定参数
+func hasArg(args []string, name string) bool {
+	for _, arg := range args {
+		if arg == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 在命令参数的URL（最后一个参数）之前插入额外参数
+func insertArgsBeforeURL(args []string, extra ...string) []string {
+	if len(args) == 0 {
+		return extra
+	}
+	result := make([]string, 0, len(args)+len(extra))
+	result = append(result, args[:len(args)-1]...)
+	result = append(result, extra...)
+	return append(result, args[len(args)-1])
+}
+
 // 从分辨率字符串中提取高度值
 func extractHeightFromResolution(resolution string) string {
 	switch resolution {
@@ -1649,6 +7167,8 @@ func handleFFmpegDownload(w http.ResponseWriter, r *http.Request) {
 			updateTasksMu.Lock()
 			delete(updateTasks, req.TaskID)
 			updateTasksMu.Unlock()
+			// 工具任务不是下载任务，结束后不再需要消息缓存
+			dropTaskBacklog(req.TaskID)
 		}()
 
 		downloadURL := getFFmpegDownloadURL()
@@ -1685,6 +7205,8 @@ func handleFFmpegDownload(w http.ResponseWriter, r *http.Request) {
 		// 清理临时文件
 		os.Remove(zipPath)
 
+		// 之前因为没有FFmpeg而失败的缩略图可以重新生成
+		clearThumbnailFailures()
 		sendUpdateProgress(req.TaskID, 100, "FFmpeg download completed successfully!", "complete")
 		log.Println("FFmpeg download completed successfully")
 	}()
@@ -1811,6 +7333,8 @@ func handleVersionUpdate(w http.ResponseWriter, r *http.Request) {
 			updateTasksMu.Lock()
 			delete(updateTasks, req.TaskID)
 			updateTasksMu.Unlock()
+			// 工具任务不是下载任务，结束后不再需要消息缓存
+			dropTaskBacklog(req.TaskID)
 		}()
 
 		// 发送开始更新消息
@@ -1902,19 +7426,27 @@ func handleVersionUpdate(w http.ResponseWriter, r *http.Request) {
 		default:
 		}
 
-		// 停止所有使用yt-dlp的任务
-		tasksMu.Lock()
-		for taskID, cmd := range activeTasks {
-			if cmd != nil {
-				sendMessageToTask(taskID, "检测到yt-dlp更新，正在停止当前任务...", "log")
-				cmd.Process.Kill()
+		// 停止所有使用yt-dlp的任务，让它们回到队列中，更新完成前不再启动新任务
+		var runningCmds = make(map[string]*exec.Cmd)
+		jobsMu.Lock()
+		holdJobs = true
+		for _, job := range jobs {
+			if job.Status == JobRunning && job.cmd != nil && job.cmd.Process != nil {
+				job.interrupt = JobQueued
+				runningCmds[job.ID] = job.cmd
 			}
 		}
-		// 清空活跃任务
-		for taskID := range activeTasks {
-			delete(activeTasks, taskID)
+		jobsMu.Unlock()
+		defer func() {
+			jobsMu.Lock()
+			holdJobs = false
+			jobsMu.Unlock()
+			scheduleJobs()
+		}()
+		for taskID, cmd := range runningCmds {
+			sendMessageToTask(taskID, "检测到yt-dlp更新，正在停止当前任务，更新完成后重新加入下载队列...", "log")
+			cmd.Process.Kill()
 		}
-		tasksMu.Unlock()
 
 		// 等待进程完全停止
 		time.Sleep(2 * time.Second)
@@ -2014,7 +7546,7 @@ func sendUpdateProgress(taskID string, progress int, message, status string) {
 
 	sentCount := 0
 	for conn, clientInfo := range clients {
-		if clientInfo.TaskID == taskID {
+		if clientInfo.TaskID == taskID || clientInfo.Topics[TopicTools] {
 			err := conn.WriteJSON(progressMsg)
 			if err != nil {
 				log.Printf("发送更新进度消息错误: %v", err)
@@ -2255,6 +7787,17 @@ func extractTarXzFFmpeg(tarXzPath, taskID, binDir string) error {
 		return fmt.Errorf("failed to set permissions on ffmpeg: %v", err)
 	}
 
+	// 同一目录中的ffprobe用于分析视频信息
+	ffprobePath := filepath.Join(filepath.Dir(ffmpegPath), "ffprobe")
+	if _, err := os.Stat(ffprobePath); err == nil {
+		probeTarget := filepath.Join(binDir, "ffprobe")
+		if err := copyFile(ffprobePath, probeTarget); err != nil {
+			log.Printf("Warning: failed to copy ffprobe: %v", err)
+		} else {
+			os.Chmod(probeTarget, 0755)
+		}
+	}
+
 	// 清理临时解压的文件
 	go func() {
 		// 删除解压出来的临时目录